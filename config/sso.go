@@ -17,11 +17,14 @@ type SSOConfig struct {
 	// additional scopes (on top of "openid")
 	Scopes        []string        `json:"scopes,omitempty"`
 	SessionExpiry metav1.Duration `json:"sessionExpiry,omitempty"`
-	// customGroupClaimName will override the groups claim name
+	// customGroupClaimName will override the groups claim name, or dot separated path to a nested claim
 	CustomGroupClaimName string   `json:"customGroupClaimName,omitempty"`
 	UserInfoPath         string   `json:"userInfoPath,omitempty"`
 	InsecureSkipVerify   bool     `json:"insecureSkipVerify,omitempty"`
 	FilterGroupsRegex    []string `json:"filterGroupsRegex,omitempty"`
+	// groupsDelimiters, if set, splits a groups claim sent as a single delimited string (e.g. "a,b c") on any of these
+	// characters, rather than treating it as one group
+	GroupsDelimiters string `json:"groupsDelimiters,omitempty"`
 }
 
 func (c SSOConfig) GetSessionExpiry() time.Duration {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strings"
 	"time"
@@ -15,6 +16,7 @@ import (
 	grpc_logrus "github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/soheilhy/cmux"
@@ -131,6 +133,159 @@ func getResourceCacheNamespace(managedNamespace string) string {
 	return v1.NamespaceAll
 }
 
+// getGatekeeperOptions returns the optional gatekeeper behaviour configured by environment variables.
+func getGatekeeperOptions() ([]auth.GatekeeperOption, error) {
+	opts := []auth.GatekeeperOption{auth.WithMetrics(prometheus.DefaultRegisterer)}
+	concurrencyLimit, err := env.GetInt("ARGO_SERVER_CONCURRENCY_LIMIT", 0)
+	if err != nil {
+		return nil, fmt.Errorf("ARGO_SERVER_CONCURRENCY_LIMIT must be an integer: %w", err)
+	}
+	if methods := env.GetString("ARGO_SERVER_CONCURRENCY_LIMITED_METHODS", ""); concurrencyLimit > 0 && methods != "" {
+		opts = append(opts, auth.WithConcurrencyLimit(concurrencyLimit, strings.Split(methods, ",")...))
+	}
+	if value := env.GetString("SSO_AUDIT_REDACT", ""); value != "" {
+		rules, err := auth.ParseAuditRedactionRules(value)
+		if err != nil {
+			return nil, fmt.Errorf("SSO_AUDIT_REDACT is invalid: %w", err)
+		}
+		opts = append(opts, auth.WithAuditRedaction(rules))
+	}
+	switch policy := auth.NamespaceConflictPolicy(env.GetString("ARGO_SERVER_NAMESPACE_CONFLICT_POLICY", "")); policy {
+	case auth.NamespaceConflictIgnore:
+	case auth.NamespaceConflictReject, auth.NamespaceConflictRestrict:
+		opts = append(opts, auth.WithNamespaceConflictPolicy(policy))
+	default:
+		return nil, fmt.Errorf("ARGO_SERVER_NAMESPACE_CONFLICT_POLICY must be one of \"reject\" or \"restrict\", got %q", policy)
+	}
+	requireCredentials, err := env.GetBool("ARGO_SERVER_REQUIRE_CREDENTIALS", false)
+	if err != nil {
+		return nil, fmt.Errorf("ARGO_SERVER_REQUIRE_CREDENTIALS must be a bool: %w", err)
+	}
+	if requireCredentials {
+		opts = append(opts, auth.WithRequireCredentials())
+	}
+	if schemes := env.GetString("ARGO_SERVER_BEARER_SCHEME_ALIASES", ""); schemes != "" {
+		opts = append(opts, auth.WithBearerSchemeAliases(strings.Split(schemes, ",")...))
+	}
+	if methods := env.GetString("ARGO_SERVER_DENIED_METHODS", ""); methods != "" {
+		opts = append(opts, auth.WithDeniedMethods(strings.Split(methods, ",")...))
+	}
+	identityHeaders, err := env.GetBool("ARGO_SERVER_IDENTITY_HEADERS", false)
+	if err != nil {
+		return nil, fmt.Errorf("ARGO_SERVER_IDENTITY_HEADERS must be a bool: %w", err)
+	}
+	if identityHeaders {
+		opts = append(opts, auth.WithIdentityHeaders())
+	}
+	verboseDenials, err := env.GetBool("ARGO_SERVER_VERBOSE_DENIALS", false)
+	if err != nil {
+		return nil, fmt.Errorf("ARGO_SERVER_VERBOSE_DENIALS must be a bool: %w", err)
+	}
+	if verboseDenials {
+		opts = append(opts, auth.WithVerboseDenials())
+	}
+	if rules := env.GetString("SSO_AUDIT_PRIMARY_GROUP_RULES", ""); rules != "" {
+		opts = append(opts, auth.WithAuditPrimaryGroup(strings.Split(rules, ";")...))
+	}
+	clientCacheTTL, err := time.ParseDuration(env.GetString("SSO_CLIENT_CACHE_TTL", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("SSO_CLIENT_CACHE_TTL must be a duration: %w", err)
+	}
+	opts = append(opts, auth.WithClientCacheTTL(clientCacheTTL))
+	serviceAccountCacheTTL, err := time.ParseDuration(env.GetString("SSO_SERVICE_ACCOUNT_CACHE_TTL", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("SSO_SERVICE_ACCOUNT_CACHE_TTL must be a duration: %w", err)
+	}
+	opts = append(opts, auth.WithServiceAccountCacheTTL(serviceAccountCacheTTL))
+	claimsClockSkew, err := time.ParseDuration(env.GetString("SSO_CLAIMS_CLOCK_SKEW", "1m"))
+	if err != nil {
+		return nil, fmt.Errorf("SSO_CLAIMS_CLOCK_SKEW must be a duration: %w", err)
+	}
+	opts = append(opts, auth.WithClaimsClockSkew(claimsClockSkew))
+	streamReauthorizationInterval, err := time.ParseDuration(env.GetString("ARGO_SERVER_STREAM_REAUTH_INTERVAL", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("ARGO_SERVER_STREAM_REAUTH_INTERVAL must be a duration: %w", err)
+	}
+	opts = append(opts, auth.WithStreamReauthorization(streamReauthorizationInterval))
+	if name := env.GetString("ARGO_SERVER_ANONYMOUS_SERVICE_ACCOUNT", ""); name != "" {
+		opts = append(opts, auth.WithAnonymousServiceAccount(name))
+	}
+	if name := env.GetString("ARGO_SERVER_AUTH_COOKIE_NAME", ""); name != "" {
+		opts = append(opts, auth.WithCookieName(name))
+	}
+	if names := env.GetString("ARGO_SERVER_AUTH_HEADERS", ""); names != "" {
+		opts = append(opts, auth.WithAuthHeaders(strings.Split(names, ",")...))
+	}
+	if proxies := env.GetString("ARGO_SERVER_TRUSTED_PROXIES", ""); proxies != "" {
+		var prefixes []netip.Prefix
+		for _, proxy := range strings.Split(proxies, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(proxy))
+			if err != nil {
+				return nil, fmt.Errorf("ARGO_SERVER_TRUSTED_PROXIES must be a comma separated list of CIDRs: %w", err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		opts = append(opts, auth.WithTrustedProxies(prefixes...))
+	}
+	ssoAuthorizeTimeout, err := time.ParseDuration(env.GetString("SSO_AUTHORIZE_TIMEOUT", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("SSO_AUTHORIZE_TIMEOUT must be a duration: %w", err)
+	}
+	opts = append(opts, auth.WithSSOAuthorizeTimeout(ssoAuthorizeTimeout))
+	tokenExpiration, err := time.ParseDuration(env.GetString("SSO_SERVICE_ACCOUNT_TOKEN_EXPIRATION", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("SSO_SERVICE_ACCOUNT_TOKEN_EXPIRATION must be a duration: %w", err)
+	}
+	opts = append(opts, auth.WithServiceAccountTokenRequest(tokenExpiration))
+	subjectRateLimit, err := env.GetFloat64("SSO_SUBJECT_RATE_LIMIT", 0)
+	if err != nil {
+		return nil, fmt.Errorf("SSO_SUBJECT_RATE_LIMIT must be a number: %w", err)
+	}
+	subjectRateLimitBurst, err := env.GetInt("SSO_SUBJECT_RATE_LIMIT_BURST", 10)
+	if err != nil {
+		return nil, fmt.Errorf("SSO_SUBJECT_RATE_LIMIT_BURST must be an int: %w", err)
+	}
+	opts = append(opts, auth.WithSubjectRateLimit(subjectRateLimit, subjectRateLimitBurst))
+	if audience := env.GetString("SSO_REQUIRED_AUDIENCE", ""); audience != "" {
+		opts = append(opts, auth.WithSSORequiredAudience(audience))
+	}
+	unavailable, err := env.GetBool("SSO_RBAC_UNAVAILABLE_ON_ERROR", false)
+	if err != nil {
+		return nil, fmt.Errorf("SSO_RBAC_UNAVAILABLE_ON_ERROR must be a bool: %w", err)
+	}
+	if unavailable {
+		opts = append(opts, auth.WithSSORBACUnavailableOnTransientErrors())
+	}
+	skipInvalidPrecedence, err := env.GetBool("SSO_RBAC_SKIP_INVALID_PRECEDENCE", false)
+	if err != nil {
+		return nil, fmt.Errorf("SSO_RBAC_SKIP_INVALID_PRECEDENCE must be a bool: %w", err)
+	}
+	if skipInvalidPrecedence {
+		opts = append(opts, auth.WithSkipInvalidPrecedence())
+	}
+	preferNamespace, err := env.GetBool("SSO_DELEGATE_RBAC_PREFER_NAMESPACE", false)
+	if err != nil {
+		return nil, fmt.Errorf("SSO_DELEGATE_RBAC_PREFER_NAMESPACE must be a bool: %w", err)
+	}
+	if preferNamespace {
+		opts = append(opts, auth.WithSSODelegationPreferNamespace())
+	}
+	if name := env.GetString("SSO_RBAC_FALLBACK_SERVICE_ACCOUNT", ""); name != "" {
+		opts = append(opts, auth.WithSSOFallbackServiceAccount(name))
+	}
+	if rule := env.GetString("SSO_RBAC_DENY_RULE", ""); rule != "" {
+		opts = append(opts, auth.WithSSODenyRule(rule))
+	}
+	if value := env.GetString("SSO_DELEGATE_RBAC_NAMESPACES", ""); value != "" {
+		namespaces, err := auth.ParseSSODelegationNamespaces(value)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, auth.WithSSODelegationNamespaces(namespaces...))
+	}
+	return opts, nil
+}
+
 func NewArgoServer(ctx context.Context, opts ArgoServerOpts) (*argoServer, error) {
 	configController := config.NewController(opts.Namespace, opts.ConfigName, opts.Clients.Kubernetes)
 	var resourceCache *cache.ResourceCache = nil
@@ -145,6 +300,16 @@ func NewArgoServer(ctx context.Context, opts ArgoServerOpts) (*argoServer, error
 			return nil, err
 		}
 		if ssoIf.IsRBACEnabled() {
+			failFast, err := env.GetBool("SSO_RBAC_VALIDATE_NAMESPACE", false)
+			if err != nil {
+				return nil, fmt.Errorf("SSO_RBAC_VALIDATE_NAMESPACE must be a bool: %w", err)
+			}
+			if err := auth.ValidateSSONamespace(ctx, opts.Clients.Kubernetes, opts.SSONamespace); err != nil {
+				if failFast {
+					return nil, err
+				}
+				log.WithError(err).Warn("SSO RBAC is misconfigured")
+			}
 			// resourceCache is only used for SSO RBAC
 			resourceCache = cache.NewResourceCache(opts.Clients.Kubernetes, getResourceCacheNamespace(opts.ManagedNamespace))
 			resourceCache.Run(ctx.Done())
@@ -153,10 +318,23 @@ func NewArgoServer(ctx context.Context, opts ArgoServerOpts) (*argoServer, error
 	} else {
 		log.Info("SSO disabled")
 	}
-	gatekeeper, err := auth.NewGatekeeper(opts.AuthModes, opts.Clients, opts.RestConfig, ssoIf, auth.DefaultClientForAuthorization, opts.Namespace, opts.SSONamespace, opts.Namespaced, resourceCache)
+	if opts.AuthModes[auth.Anonymous] && resourceCache == nil {
+		// the anonymous service account is read from the cache too
+		resourceCache = cache.NewResourceCache(opts.Clients.Kubernetes, getResourceCacheNamespace(opts.ManagedNamespace))
+		resourceCache.Run(ctx.Done())
+	}
+	gatekeeperOpts, err := getGatekeeperOptions()
+	if err != nil {
+		return nil, err
+	}
+	gatekeeper, err := auth.NewGatekeeper(opts.AuthModes, opts.Clients, opts.RestConfig, ssoIf, auth.DefaultClientForAuthorization, opts.Namespace, opts.SSONamespace, opts.Namespaced, resourceCache, gatekeeperOpts...)
 	if err != nil {
 		return nil, err
 	}
+	if err := gatekeeper.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth configuration: %w", err)
+	}
+	log.WithField("hash", gatekeeper.ConfigHash()).Info("Auth config")
 	store, err := memorystore.New(&memorystore.Config{
 		Tokens:   opts.APIRateLimit,
 		Interval: time.Second,
@@ -374,6 +552,13 @@ func (as *argoServer) newHTTPServer(ctx context.Context, port int, artifactServe
 	gwMuxOpts := runtime.WithMarshalerOption(runtime.MIMEWildcard, new(json.JSONMarshaler))
 	gwmux := runtime.NewServeMux(gwMuxOpts,
 		runtime.WithIncomingHeaderMatcher(func(key string) (string, bool) { return key, true }),
+		runtime.WithOutgoingHeaderMatcher(func(key string) (string, bool) {
+			// identity headers are for proxies, which expect them verbatim
+			if strings.HasPrefix(key, auth.IdentityHeaderPrefix) {
+				return key, true
+			}
+			return runtime.MetadataHeaderPrefix + key, true
+		}),
 		runtime.WithProtoErrorHandler(runtime.DefaultHTTPProtoErrorHandler),
 	)
 	mustRegisterGWHandler(infopkg.RegisterInfoServiceHandlerFromEndpoint, ctx, gwmux, endpoint, dialOpts)
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/argoproj/argo-workflows/v3/server/auth/types"
+)
+
+// AuditRedaction is what to do with a claim when it is written to an audit entry.
+type AuditRedaction string
+
+// AuditEntry records a single authentication and authorization decision.
+type AuditEntry struct {
+	// Method is the full gRPC method, e.g. "/workflow.WorkflowService/ListWorkflows", or "" outside gRPC.
+	Method    string
+	Namespace string
+	// Mode is the auth mode of the accepted token, or "" if no mode accepted it.
+	Mode    Mode
+	Allowed bool
+	// Err is why the request was denied.
+	Err error
+	// Fields are the (redacted) claims, as written to the audit log, or nil if the user was not identified.
+	Fields log.Fields
+}
+
+// AuditSink records every decision the gatekeeper makes, e.g. to keep a durable audit trail. Record is called
+// synchronously on the request path, so it should not block.
+type AuditSink interface {
+	Record(entry AuditEntry)
+}
+
+type noopAuditSink struct{}
+
+func (noopAuditSink) Record(AuditEntry) {}
+
+const (
+	AuditKeep   AuditRedaction = "keep"
+	AuditRedact AuditRedaction = "redact"
+	// AuditHash replaces the value with a SHA-256 hash, so entries for the same user can still be correlated.
+	AuditHash AuditRedaction = "hash"
+)
+
+// ParseAuditRedactionRules parses a comma separated list of claim=redaction pairs, e.g. "email=hash,name=redact".
+func ParseAuditRedactionRules(value string) (map[string]AuditRedaction, error) {
+	rules := map[string]AuditRedaction{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		claim, redaction, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid audit redaction rule %q, expected claim=redaction", pair)
+		}
+		switch r := AuditRedaction(strings.TrimSpace(redaction)); r {
+		case AuditKeep, AuditRedact, AuditHash:
+			rules[strings.TrimSpace(claim)] = r
+		default:
+			return nil, fmt.Errorf("invalid audit redaction %q for claim %q", redaction, claim)
+		}
+	}
+	return rules, nil
+}
+
+// redact applies the configured rule for the named claim (e.g. "sub", "email") to its value.
+func (s *gatekeeper) redact(claim, value string) string {
+	switch s.auditRedactionRules[claim] {
+	case AuditRedact:
+		return "REDACTED"
+	case AuditHash:
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	default:
+		return value
+	}
+}
+
+// primaryGroup returns the first of the claims' groups matching the highest precedence primary group rule, or "" if
+// none do. Each rule is an expression evaluated with `group` (the candidate) and `groups` (all groups).
+func (s *gatekeeper) primaryGroup(claims *types.Claims) string {
+	for _, rule := range s.auditPrimaryGroupRules {
+		for _, group := range claims.Groups {
+			ok, err := s.ruleCache.evalBool(rule, map[string]interface{}{"group": group, "groups": claims.Groups})
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{"rule": rule, "group": s.redact("groups", group)}).Warn("failed to evaluate audit primary group rule, skipping the rule")
+				break
+			}
+			if ok {
+				return group
+			}
+		}
+	}
+	return ""
+}
+
+// addMethodLogField adds the gRPC method of the request, if any, to the fields of an audit log entry.
+func addMethodLogField(ctx context.Context, fields log.Fields) log.Fields {
+	if method, ok := grpc.Method(ctx); ok {
+		fields["method"] = method
+	}
+	return fields
+}
+
+func (s *gatekeeper) recordAudit(ctx context.Context, req interface{}, mode Mode, claims *types.Claims, err error) {
+	if _, ok := s.auditSink.(noopAuditSink); ok {
+		// nothing would record the entry, so don't build it
+		return
+	}
+	entry := AuditEntry{Namespace: getNamespace(req), Mode: mode, Allowed: err == nil, Err: err}
+	entry.Method, _ = grpc.Method(ctx)
+	if claims != nil {
+		entry.Fields = s.addClaimsLogFields(claims, nil)
+	}
+	s.auditSink.Record(entry)
+}
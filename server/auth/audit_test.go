@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-jose/go-jose/v3/jwt"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+
+	workflowpkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/workflow"
+	ssomocks "github.com/argoproj/argo-workflows/v3/server/auth/sso/mocks"
+	"github.com/argoproj/argo-workflows/v3/server/auth/types"
+	"github.com/argoproj/argo-workflows/v3/server/cache"
+	servertypes "github.com/argoproj/argo-workflows/v3/server/types"
+	"github.com/argoproj/argo-workflows/v3/workflow/common"
+)
+
+func TestParseAuditRedactionRules(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		rules, err := ParseAuditRedactionRules("email=hash, sub=redact,name=keep")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]AuditRedaction{"email": AuditHash, "sub": AuditRedact, "name": AuditKeep}, rules)
+	})
+	t.Run("MissingRedaction", func(t *testing.T) {
+		_, err := ParseAuditRedactionRules("email")
+		assert.Error(t, err)
+	})
+	t.Run("UnknownRedaction", func(t *testing.T) {
+		_, err := ParseAuditRedactionRules("email=shred")
+		assert.Error(t, err)
+	})
+}
+
+func TestGatekeeper_addClaimsLogFields(t *testing.T) {
+	claims := &types.Claims{Claims: jwt.Claims{Subject: "my-sub"}, Email: "me@example.com"}
+	t.Run("Default", func(t *testing.T) {
+		s := &gatekeeper{}
+		assert.Equal(t, log.Fields{"subject": "my-sub", "email": "me@example.com"}, s.addClaimsLogFields(claims, nil))
+	})
+	t.Run("Redact", func(t *testing.T) {
+		s := &gatekeeper{auditRedactionRules: map[string]AuditRedaction{"email": AuditRedact}}
+		assert.Equal(t, log.Fields{"subject": "my-sub", "email": "REDACTED"}, s.addClaimsLogFields(claims, nil))
+	})
+	t.Run("Hash", func(t *testing.T) {
+		s := &gatekeeper{auditRedactionRules: map[string]AuditRedaction{"sub": AuditHash}}
+		assert.Equal(t, log.Fields{"subject": "sha256:de00ce65741e4cf2baaeeffed7f9c85428c880fc096df133b6a75fb8f55eac0d", "email": "me@example.com"}, s.addClaimsLogFields(claims, nil))
+	})
+	t.Run("GroupsAndServiceAccount", func(t *testing.T) {
+		s := &gatekeeper{}
+		claims := &types.Claims{Claims: jwt.Claims{Subject: "my-sub"}, Groups: []string{"a", "b"}, ServiceAccountName: "my-sa"}
+		assert.Equal(t, log.Fields{"subject": "my-sub", "groups": []string{"a", "b"}, "groupCount": 2, "serviceAccount": "my-sa"}, s.addClaimsLogFields(claims, nil))
+		assert.Equal(t, "other-sa", s.addClaimsLogFields(claims, log.Fields{"serviceAccount": "other-sa"})["serviceAccount"])
+	})
+	t.Run("ManyGroups", func(t *testing.T) {
+		s := &gatekeeper{auditRedactionRules: map[string]AuditRedaction{"groups": AuditRedact}}
+		groups := make([]string, 100)
+		for i := range groups {
+			groups[i] = fmt.Sprintf("group-%d", i)
+		}
+		fields := s.addClaimsLogFields(&types.Claims{Groups: groups}, nil)
+		assert.Len(t, fields["groups"], maxLoggedGroups)
+		assert.Equal(t, "REDACTED", fields["groups"].([]string)[0])
+		assert.Equal(t, 100, fields["groupCount"])
+	})
+}
+
+func TestGatekeeper_primaryGroup(t *testing.T) {
+	s := &gatekeeper{auditPrimaryGroupRules: []string{`group startsWith "team-"`, `group == "everyone"`}, ruleCache: newRuleCache()}
+	t.Run("HighestPrecedence", func(t *testing.T) {
+		claims := &types.Claims{Groups: []string{"everyone", "team-a", "team-b"}}
+		assert.Equal(t, "team-a", s.primaryGroup(claims))
+		assert.Equal(t, "team-a", s.addClaimsLogFields(claims, nil)["primaryGroup"])
+	})
+	t.Run("LowerPrecedence", func(t *testing.T) {
+		assert.Equal(t, "everyone", s.primaryGroup(&types.Claims{Groups: []string{"admins", "everyone"}}))
+	})
+	t.Run("NoMatch", func(t *testing.T) {
+		assert.Empty(t, s.primaryGroup(&types.Claims{Groups: []string{"admins"}}))
+	})
+	t.Run("NoGroups", func(t *testing.T) {
+		assert.NotContains(t, s.addClaimsLogFields(&types.Claims{}, nil), "primaryGroup")
+	})
+	t.Run("Redacted", func(t *testing.T) {
+		s := &gatekeeper{auditPrimaryGroupRules: s.auditPrimaryGroupRules, auditRedactionRules: map[string]AuditRedaction{"groups": AuditRedact}, ruleCache: newRuleCache()}
+		assert.Equal(t, "REDACTED", s.addClaimsLogFields(&types.Claims{Groups: []string{"team-a"}}, nil)["primaryGroup"])
+	})
+	t.Run("InvalidRule", func(t *testing.T) {
+		hook := &test.Hook{}
+		defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+		log.AddHook(hook)
+		s := &gatekeeper{auditPrimaryGroupRules: []string{"group +", `group == "everyone"`}, ruleCache: newRuleCache()}
+		assert.Equal(t, "everyone", s.primaryGroup(&types.Claims{Groups: []string{"everyone"}}))
+		require.Len(t, hook.AllEntries(), 1)
+		assert.Equal(t, "failed to evaluate audit primary group rule, skipping the rule", hook.LastEntry().Message)
+		assert.Equal(t, "everyone", hook.LastEntry().Data["group"])
+	})
+}
+
+type recordingAuditSink []AuditEntry
+
+func (r *recordingAuditSink) Record(entry AuditEntry) {
+	*r = append(*r, entry)
+}
+
+// methodStream sets the gRPC method of the context, as the gRPC server does.
+type methodStream struct {
+	grpc.ServerTransportStream
+	method string
+}
+
+func (s methodStream) Method() string {
+	return s.method
+}
+
+func TestGatekeeper_AuditSink(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: `"my-group" in groups`}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:allowed").Return(&types.Claims{Claims: jwt.Claims{Subject: "my-sub"}, Groups: []string{"my-group"}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:denied").Return(&types.Claims{Claims: jwt.Claims{Subject: "other-sub"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	sink := &recordingAuditSink{}
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithAuditSink(sink))
+	require.NoError(t, err)
+	ctx := func(authorization string) context.Context {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.New(map[string]string{"authorization": authorization}))
+		return grpc.NewContextWithServerTransportStream(ctx, methodStream{method: "/workflow.WorkflowService/ListWorkflows"})
+	}
+	req := &workflowpkg.WorkflowListRequest{Namespace: "my-ns"}
+
+	t.Run("Allowed", func(t *testing.T) {
+		*sink = nil
+		_, err := g.ContextWithRequest(ctx("Bearer v2:allowed"), req)
+		require.NoError(t, err)
+		require.Len(t, *sink, 1)
+		entry := (*sink)[0]
+		assert.Equal(t, "/workflow.WorkflowService/ListWorkflows", entry.Method)
+		assert.Equal(t, "my-ns", entry.Namespace)
+		assert.Equal(t, SSO, entry.Mode)
+		assert.True(t, entry.Allowed)
+		assert.NoError(t, entry.Err)
+		assert.Equal(t, "my-sub", entry.Fields["subject"])
+	})
+	t.Run("Denied", func(t *testing.T) {
+		*sink = nil
+		hook := &test.Hook{}
+		defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+		log.AddHook(hook)
+		_, err := g.ContextWithRequest(ctx("Bearer v2:denied"), req)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+		logEntry := hook.LastEntry()
+		require.NotNil(t, logEntry)
+		assert.Equal(t, "failed to perform RBAC authorization", logEntry.Message)
+		assert.Equal(t, "/workflow.WorkflowService/ListWorkflows", logEntry.Data["method"])
+		require.Len(t, *sink, 1)
+		entry := (*sink)[0]
+		assert.Equal(t, "/workflow.WorkflowService/ListWorkflows", entry.Method)
+		assert.Equal(t, SSO, entry.Mode)
+		assert.False(t, entry.Allowed)
+		assert.Equal(t, codes.PermissionDenied, status.Code(entry.Err))
+		assert.Equal(t, "other-sub", entry.Fields["subject"])
+	})
+	t.Run("Unauthenticated", func(t *testing.T) {
+		*sink = nil
+		_, err := g.Context(ctx("garbage"))
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		require.Len(t, *sink, 1)
+		entry := (*sink)[0]
+		assert.Empty(t, entry.Mode)
+		assert.False(t, entry.Allowed)
+		assert.Nil(t, entry.Fields)
+	})
+}
@@ -2,6 +2,8 @@ package auth
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
 )
@@ -11,6 +13,9 @@ type authorizingServerStream struct {
 	grpc.ServerStream
 	ctx context.Context
 	Gatekeeper
+	mu sync.Mutex
+	// the last request that was authorized, nil until the first one is received
+	req interface{}
 }
 
 func NewAuthorizingServerStream(ss grpc.ServerStream, gk Gatekeeper) *authorizingServerStream {
@@ -40,5 +45,42 @@ func (l *authorizingServerStream) RecvMsg(m interface{}) error {
 		return err
 	}
 	l.ctx = ctx
+	l.mu.Lock()
+	l.req = m
+	l.mu.Unlock()
 	return nil
 }
+
+// reauthorize authorizes the last request again every interval, until ctx is done or authorization fails, so a
+// long-lived stream does not outlive a revoked token or a deleted service account.
+func (l *authorizingServerStream) reauthorize(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			l.mu.Lock()
+			req := l.req
+			l.mu.Unlock()
+			if req == nil {
+				// nothing has been authorized yet
+				continue
+			}
+			if _, err := l.Gatekeeper.ContextWithRequest(ctx, req); err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+}
+
+// cancellableServerStream replaces the context of a stream, e.g. so that it can be cancelled.
+type cancellableServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *cancellableServerStream) Context() context.Context {
+	return s.ctx
+}
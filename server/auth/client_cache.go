@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	servertypes "github.com/argoproj/argo-workflows/v3/server/types"
+)
+
+// clientCacheKey includes the resource version of the token secret, so a rotated token is never served from the cache.
+type clientCacheKey struct {
+	namespace          string
+	serviceAccountName string
+	resourceVersion    string
+}
+
+type clientCacheEntry struct {
+	clients    *servertypes.Clients
+	expiryTime time.Time
+}
+
+// clientCache caches the clients built for SSO RBAC service accounts, which are otherwise rebuilt for every request.
+type clientCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[clientCacheKey]clientCacheEntry
+}
+
+func newClientCache(ttl time.Duration) *clientCache {
+	return &clientCache{ttl: ttl, entries: map[clientCacheKey]clientCacheEntry{}}
+}
+
+func (c *clientCache) get(key clientCacheKey) (*servertypes.Clients, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().Before(entry.expiryTime) {
+		return entry.clients, true
+	}
+	return nil, false
+}
+
+// invalidate drops the entries of the service account, for every resource version of its token secret.
+func (c *clientCache) invalidate(namespace, serviceAccountName string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		if k.namespace == namespace && k.serviceAccountName == serviceAccountName {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *clientCache) add(key clientCacheKey, clients *servertypes.Clients) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// evict expired entries, including those for previous token resource versions, which are never read again
+	for k, entry := range c.entries {
+		if !now.Before(entry.expiryTime) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = clientCacheEntry{clients: clients, expiryTime: now.Add(c.ttl)}
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/peer"
+
+	"github.com/argoproj/argo-workflows/v3/server/auth/types"
+)
+
+// concurrencyLimiter bounds the number of in-flight calls a single subject may have to heavy methods, so one user
+// cannot monopolize the server.
+type concurrencyLimiter struct {
+	limit    int
+	methods  map[string]bool
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newConcurrencyLimiter(limit int, methods []string) *concurrencyLimiter {
+	l := &concurrencyLimiter{limit: limit, methods: map[string]bool{}, inFlight: map[string]int{}}
+	for _, method := range methods {
+		l.methods[method] = true
+	}
+	return l
+}
+
+// acquire returns a release func, or false if the subject is already at the limit. Methods that are not limited
+// are always acquired. In-flight operations are recorded with the metrics.
+func (l *concurrencyLimiter) acquire(method, subject string, metrics *gatekeeperMetrics) (func(), bool) {
+	if l == nil || !l.methods[method] {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[subject] >= l.limit {
+		return nil, false
+	}
+	l.inFlight[subject]++
+	metrics.observeConcurrentOperation(method, 1)
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.inFlight[subject]--
+		if l.inFlight[subject] <= 0 {
+			delete(l.inFlight, subject)
+		}
+		metrics.observeConcurrentOperation(method, -1)
+	}, true
+}
+
+type concurrencySlotKey struct{}
+
+// concurrencySlot is a call's place in the concurrency limiter. It is acquired when the call is first authorized, and
+// released when the call ends.
+type concurrencySlot struct {
+	method   string
+	mu       sync.Mutex
+	acquired bool
+	release  func()
+}
+
+func withConcurrencySlot(ctx context.Context, method string) (context.Context, *concurrencySlot) {
+	slot := &concurrencySlot{method: method}
+	return context.WithValue(ctx, concurrencySlotKey{}, slot), slot
+}
+
+func (s *concurrencySlot) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.release != nil {
+		s.release()
+		s.release = nil
+	}
+}
+
+// concurrencyKey identifies the caller to the concurrency limiter: by subject, or else by a hash of their token. In
+// Server mode every caller has the server's claims, so they are told apart by token too. Callers without a token are
+// told apart by their address, so one of them cannot use up the limit for the others, though callers behind the same
+// proxy share one limit.
+func concurrencyKey(ctx context.Context, mode Mode, claims *types.Claims, authorization string) string {
+	if mode != Server && claims != nil && claims.Subject != "" {
+		return string(mode) + ":sub:" + claims.Subject
+	}
+	if p, ok := peer.FromContext(ctx); ok && authorization == "" && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		return string(mode) + ":peer:" + host
+	}
+	sum := sha256.Sum256([]byte(authorization))
+	return string(mode) + ":token:" + hex.EncodeToString(sum[:])
+}
@@ -2,22 +2,37 @@ package auth
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
+	"reflect"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/argoproj/argo-workflows/v3/util/secrets"
 
 	eventsource "github.com/argoproj/argo-events/pkg/client/eventsource/clientset/versioned"
 	sensor "github.com/argoproj/argo-events/pkg/client/sensor/clientset/versioned"
+	"github.com/go-jose/go-jose/v3/jwt"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
@@ -29,7 +44,6 @@ import (
 	"github.com/argoproj/argo-workflows/v3/server/auth/types"
 	"github.com/argoproj/argo-workflows/v3/server/cache"
 	servertypes "github.com/argoproj/argo-workflows/v3/server/types"
-	"github.com/argoproj/argo-workflows/v3/util/expr/argoexpr"
 	jsonutil "github.com/argoproj/argo-workflows/v3/util/json"
 	"github.com/argoproj/argo-workflows/v3/util/kubeconfig"
 	"github.com/argoproj/argo-workflows/v3/workflow/common"
@@ -44,6 +58,7 @@ const (
 	EventSourceKey ContextKey = "eventsource.Interface"
 	KubeKey        ContextKey = "kubernetes.Interface"
 	ClaimsKey      ContextKey = "types.Claims"
+	ModeKey        ContextKey = "auth.Mode"
 )
 
 //go:generate mockery --name=Gatekeeper
@@ -53,8 +68,39 @@ type Gatekeeper interface {
 	Context(ctx context.Context) (context.Context, error)
 	UnaryServerInterceptor() grpc.UnaryServerInterceptor
 	StreamServerInterceptor() grpc.StreamServerInterceptor
+	// ConfigHash returns a stable hash of the effective auth config, excluding secrets.
+	ConfigHash() string
+	// EnabledModes returns the names of the enabled auth modes, sorted, e.g. for diagnostics.
+	EnabledModes() []string
+	// Invalidate drops the cached clients and token of the service account, so the next request re-resolves them,
+	// e.g. after its token secret is rotated or its RBAC rule is changed.
+	Invalidate(namespace, serviceAccountName string)
+	// Validate checks that everything the enabled modes and options depend on is configured, returning every problem
+	// found, so that a misconfiguration fails at startup rather than on the first request. Problems that NewGatekeeper
+	// already rejects, e.g. the anonymous mode without a service account or resource cache, are not checked again.
+	Validate() error
 }
 
+// IdentityHeaderPrefix prefixes the response headers that echo the authenticated identity, see WithIdentityHeaders.
+const IdentityHeaderPrefix = "x-auth-request-"
+
+// AnonymousSubject is the subject of the claims of requests in Anonymous mode.
+const AnonymousSubject = "system:anonymous"
+
+// RevocationChecker reports whether an SSO token has been revoked before it expired, e.g. by its "jti" claim, or its
+// subject and issue time.
+type RevocationChecker interface {
+	IsRevoked(claims *types.Claims) (bool, error)
+}
+
+// ClaimsEnricher adds to the claims of SSO users before they are used for SSO RBAC, e.g. groups from an external
+// directory.
+type ClaimsEnricher interface {
+	Enrich(ctx context.Context, claims *types.Claims) error
+}
+
+// ClientForAuthorization builds the clients for an authorization, in Client mode and for SSO RBAC service
+// accounts. Override it to inject clients in tests or for custom token exchange.
 type ClientForAuthorization func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error)
 
 type gatekeeper struct {
@@ -69,28 +115,148 @@ type gatekeeper struct {
 	ssoNamespace string
 	namespaced   bool
 	cache        *cache.ResourceCache
+	// run against every candidate token before the mode is resolved
+	tokenValidators []TokenValidator
+	// nil unless limits are configured
+	concurrencyLimiter *concurrencyLimiter
+	// nil if metrics are not registered
+	metrics *gatekeeperMetrics
+	// claim name to redaction, claims without a rule are kept
+	auditRedactionRules map[string]AuditRedaction
+	// what to do when the request and the object in its body disagree on the namespace
+	namespaceConflictPolicy NamespaceConflictPolicy
+	// reject requests without any credentials, even in Server mode
+	requireCredentials bool
+	// in precedence order, used to tag audit entries with the user's primary group
+	auditPrimaryGroupRules []string
+	// nil if SSO RBAC clients are not cached
+	clientCache *clientCache
+	// nil unless the service accounts selected by SSO RBAC are cached
+	serviceAccountCache *serviceAccountCache
+	// compiled SSO RBAC rules
+	ruleCache *ruleCache
+	auditSink AuditSink
+	// namespaces SSO RBAC may be delegated to, nil if any namespace may be
+	ssoDelegationNamespaces map[string]bool
+	// service account in the SSO namespace used when no rule matches, "" to deny the user instead
+	ssoFallbackServiceAccount string
+	// rule that denies users whose claims it matches, before any service account is selected, "" for none
+	ssoDenyRule string
+	// custom headers that may carry a bearer token, checked after the `Authorization` header and cookie
+	authHeaders []string
+	// leeway when checking the expiry and not-before time of SSO claims
+	claimsClockSkew time.Duration
+	// how often streams are authorized again, 0 to only authorize them once
+	streamReauthorizationInterval time.Duration
+	// service account in the SSO namespace used for requests without a token in Anonymous mode
+	anonymousServiceAccount string
+	// name of the cookie that may carry the token
+	cookieName string
+	// bound on SSO authorization, 0 for no bound
+	ssoAuthorizeTimeout time.Duration
+	// audience SSO tokens must be issued for, empty to not check it
+	ssoRequiredAudience string
+	// nil unless SSO tokens are checked for revocation
+	revocationChecker RevocationChecker
+	// nil unless SSO claims are enriched before they are used
+	claimsEnricher ClaimsEnricher
+	// whether PermissionDenied errors tell the client the reason, which is always logged with the subject
+	verboseDenials bool
+	// nil unless SSO subjects are rate limited
+	subjectRateLimiter *subjectRateLimiter
+	// nil to read service account tokens from their secret, rather than minting them
+	tokenMinter *tokenMinter
+	// whether to echo the authenticated identity in response headers
+	identityHeaders bool
+	// whether a matching service account in the request namespace is delegated to regardless of precedence
+	ssoDelegationPreferNamespace bool
+	// full gRPC methods that are denied to everyone, whatever their RBAC allows
+	deniedMethods map[string]bool
+	// authorization schemes, e.g. `Token`, that are treated as `Bearer`
+	bearerSchemeAliases []string
+	// networks of the proxies trusted to set the auth headers, nil if every client is trusted
+	trustedProxies []netip.Prefix
+	// whether transient SSO RBAC errors are codes.Unavailable, rather than codes.PermissionDenied
+	ssoRBACUnavailableOnTransientErrors bool
+	// whether SSO RBAC skips service accounts with an invalid precedence, rather than giving them precedence 0
+	skipInvalidPrecedence bool
+	// service accounts, by namespace, name and resource version, already warned about for an invalid precedence
+	precedenceWarnings *sync.Map
 }
 
-func NewGatekeeper(modes Modes, clients *servertypes.Clients, restConfig *rest.Config, ssoIf sso.Interface, clientForAuthorization ClientForAuthorization, namespace string, ssoNamespace string, namespaced bool, cache *cache.ResourceCache) (Gatekeeper, error) {
+func NewGatekeeper(modes Modes, clients *servertypes.Clients, restConfig *rest.Config, ssoIf sso.Interface, clientForAuthorization ClientForAuthorization, namespace string, ssoNamespace string, namespaced bool, cache *cache.ResourceCache, opts ...GatekeeperOption) (Gatekeeper, error) {
 	if len(modes) == 0 {
 		return nil, fmt.Errorf("must specify at least one auth mode")
 	}
-	return &gatekeeper{
-		modes,
-		clients,
-		restConfig,
-		ssoIf,
-		clientForAuthorization,
-		namespace,
-		ssoNamespace,
-		namespaced,
-		cache,
-	}, nil
+	if clientForAuthorization == nil {
+		clientForAuthorization = DefaultClientForAuthorization
+	}
+	s := &gatekeeper{
+		Modes:                  modes,
+		clients:                clients,
+		restConfig:             restConfig,
+		ssoIf:                  ssoIf,
+		clientForAuthorization: clientForAuthorization,
+		namespace:              namespace,
+		ssoNamespace:           ssoNamespace,
+		namespaced:             namespaced,
+		cache:                  cache,
+		ruleCache:              newRuleCache(),
+		precedenceWarnings:     &sync.Map{},
+		claimsClockSkew:        jwt.DefaultLeeway,
+		cookieName:             "authorization",
+		auditSink:              noopAuditSink{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.ssoDelegationNamespaces != nil && os.Getenv("SSO_DELEGATE_RBAC_TO_NAMESPACE") != "true" {
+		return nil, fmt.Errorf("the SSO RBAC delegation namespaces require SSO_DELEGATE_RBAC_TO_NAMESPACE=true")
+	}
+	if modes[Anonymous] && s.anonymousServiceAccount == "" {
+		return nil, fmt.Errorf("anonymous auth mode requires an anonymous service account")
+	}
+	if modes[Anonymous] && cache == nil {
+		return nil, fmt.Errorf("anonymous auth mode requires a resource cache")
+	}
+	if s.metrics != nil {
+		s.metrics.observeConfigHash(s.ConfigHash())
+	}
+	return s, nil
+}
 
+func (s *gatekeeper) Validate() error {
+	var errs []error
+	enabled := false
+	for _, ok := range s.Modes {
+		enabled = enabled || ok
+	}
+	if !enabled {
+		errs = append(errs, errors.New("at least one auth mode must be enabled"))
+	}
+	if s.Modes[Server] && s.clients == nil {
+		errs = append(errs, errors.New("server auth mode requires the server's clients"))
+	}
+	if s.Modes[SSO] {
+		if s.ssoIf == nil {
+			errs = append(errs, errors.New("sso auth mode requires an SSO provider"))
+		} else if s.ssoIf.IsRBACEnabled() && s.cache == nil {
+			errs = append(errs, errors.New("SSO RBAC requires a resource cache"))
+		}
+	}
+	if s.ssoFallbackServiceAccount != "" && s.cache == nil {
+		errs = append(errs, errors.New("the SSO RBAC fallback service account requires a resource cache"))
+	}
+	if s.tokenMinter != nil && (s.clients == nil || s.clients.Kubernetes == nil) {
+		errs = append(errs, errors.New("minting service account tokens requires the server's Kubernetes client"))
+	}
+	return errors.Join(errs...)
 }
 
 func (s *gatekeeper) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		ctx, slot := withConcurrencySlot(ctx, info.FullMethod)
+		defer slot.done()
 		ctx, err = s.ContextWithRequest(ctx, req)
 		if err != nil {
 			return nil, err
@@ -101,12 +267,33 @@ func (s *gatekeeper) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 
 func (s *gatekeeper) StreamServerInterceptor() grpc.StreamServerInterceptor {
 	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-		return handler(srv, NewAuthorizingServerStream(ss, s))
+		ctx, slot := withConcurrencySlot(ss.Context(), info.FullMethod)
+		defer slot.done()
+		ss = &cancellableServerStream{ServerStream: ss, ctx: ctx}
+		if s.streamReauthorizationInterval <= 0 {
+			return handler(srv, NewAuthorizingServerStream(ss, s))
+		}
+		ctx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+		stream := NewAuthorizingServerStream(&cancellableServerStream{ServerStream: ss, ctx: ctx}, s)
+		reauthorized := make(chan error, 1)
+		go func() {
+			err := stream.reauthorize(ctx, s.streamReauthorizationInterval)
+			// stop the handler, which should notice the context is done
+			cancel()
+			reauthorized <- err
+		}()
+		err := handler(srv, stream)
+		cancel()
+		if reauthErr := <-reauthorized; reauthErr != nil {
+			return status.Errorf(codes.Unauthenticated, "stream re-authorization failed: %s", status.Convert(reauthErr).Message())
+		}
+		return err
 	}
 }
 
 func (s *gatekeeper) ContextWithRequest(ctx context.Context, req interface{}) (context.Context, error) {
-	clients, claims, err := s.getClients(ctx, req)
+	clients, claims, mode, err := s.getClients(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -116,13 +303,162 @@ func (s *gatekeeper) ContextWithRequest(ctx context.Context, req interface{}) (c
 	ctx = context.WithValue(ctx, SensorKey, clients.Sensor)
 	ctx = context.WithValue(ctx, KubeKey, clients.Kubernetes)
 	ctx = context.WithValue(ctx, ClaimsKey, claims)
+	ctx = context.WithValue(ctx, ModeKey, mode)
+	// the claims of the other modes are the server's or the anonymous service account's, not the user's
+	if s.identityHeaders && (mode == Client || mode == SSO) {
+		setIdentityHeaders(ctx, claims)
+	}
 	return ctx, nil
 }
 
+// setIdentityHeaders echoes the subject and email of the claims in the response headers, for proxies in front of the
+// server. It is a no-op outside a gRPC call, or once the headers have been sent, e.g. when a stream is re-authorized.
+func setIdentityHeaders(ctx context.Context, claims *types.Claims) {
+	if claims == nil || grpc.ServerTransportStreamFromContext(ctx) == nil {
+		return
+	}
+	md := metadata.MD{}
+	if claims.Subject != "" {
+		md.Set(IdentityHeaderPrefix+"user", claims.Subject)
+	}
+	if claims.Email != "" {
+		md.Set(IdentityHeaderPrefix+"email", claims.Email)
+	}
+	if len(md) == 0 {
+		return
+	}
+	if err := grpc.SetHeader(ctx, md); err != nil {
+		log.WithError(err).Debug("failed to set identity headers")
+	}
+}
+
 func (s *gatekeeper) Context(ctx context.Context) (context.Context, error) {
 	return s.ContextWithRequest(ctx, nil)
 }
 
+// authConfig is every setting that affects the gatekeeper's behaviour, used to compute the config hash.
+type authConfig struct {
+	Modes                      []string                  `json:"modes"`
+	Namespace                  string                    `json:"namespace"`
+	SSONamespace               string                    `json:"ssoNamespace"`
+	Namespaced                 bool                      `json:"namespaced"`
+	SSO                        *sso.Settings             `json:"sso,omitempty"`
+	SSORBACEnabled             bool                      `json:"ssoRBACEnabled"`
+	SSODelegateRBACToNamespace bool                      `json:"ssoDelegateRBACToNamespace"`
+	TokenValidators            int                       `json:"tokenValidators"`
+	ConcurrencyLimit           int                       `json:"concurrencyLimit,omitempty"`
+	ConcurrencyLimitedMethods  []string                  `json:"concurrencyLimitedMethods,omitempty"`
+	AuditRedactionRules        map[string]AuditRedaction `json:"auditRedactionRules,omitempty"`
+	NamespaceConflictPolicy    NamespaceConflictPolicy   `json:"namespaceConflictPolicy,omitempty"`
+	RequireCredentials         bool                      `json:"requireCredentials,omitempty"`
+	AuditPrimaryGroupRules     []string                  `json:"auditPrimaryGroupRules,omitempty"`
+	ClientCacheTTL             time.Duration             `json:"clientCacheTTL,omitempty"`
+	AuditSink                  bool                      `json:"auditSink,omitempty"`
+	ServiceAccountCacheTTL     time.Duration             `json:"serviceAccountCacheTTL,omitempty"`
+	SSODelegationNamespaces    []string                  `json:"ssoDelegationNamespaces,omitempty"`
+	SSOFallbackServiceAccount  string                    `json:"ssoFallbackServiceAccount,omitempty"`
+	SSODenyRule                string                    `json:"ssoDenyRule,omitempty"`
+	AuthHeaders                []string                  `json:"authHeaders,omitempty"`
+	ClaimsClockSkew            time.Duration             `json:"claimsClockSkew"`
+	StreamReauthorization      time.Duration             `json:"streamReauthorization,omitempty"`
+	AnonymousServiceAccount    string                    `json:"anonymousServiceAccount,omitempty"`
+	CookieName                 string                    `json:"cookieName"`
+	SSOAuthorizeTimeout        time.Duration             `json:"ssoAuthorizeTimeout,omitempty"`
+	SSORequiredAudience        string                    `json:"ssoRequiredAudience,omitempty"`
+	RevocationChecker          bool                      `json:"revocationChecker,omitempty"`
+	VerboseDenials             bool                      `json:"verboseDenials,omitempty"`
+	SubjectRateLimit           float64                   `json:"subjectRateLimit,omitempty"`
+	SubjectRateLimitBurst      int                       `json:"subjectRateLimitBurst,omitempty"`
+	ServiceAccountTokenExpiry  time.Duration             `json:"serviceAccountTokenExpiry,omitempty"`
+	IdentityHeaders            bool                      `json:"identityHeaders,omitempty"`
+	SSODelegationPreferNS      bool                      `json:"ssoDelegationPreferNamespace,omitempty"`
+	DeniedMethods              []string                  `json:"deniedMethods,omitempty"`
+	BearerSchemeAliases        []string                  `json:"bearerSchemeAliases,omitempty"`
+	TrustedProxies             []string                  `json:"trustedProxies,omitempty"`
+	SSORBACUnavailable         bool                      `json:"ssoRBACUnavailableOnTransientErrors,omitempty"`
+	SkipInvalidPrecedence      bool                      `json:"skipInvalidPrecedence,omitempty"`
+	ClaimsEnricher             bool                      `json:"claimsEnricher,omitempty"`
+	ServerTokenFile            string                    `json:"serverTokenFile,omitempty"`
+}
+
+func (s *gatekeeper) ConfigHash() string {
+	c := authConfig{
+		Namespace:                  s.namespace,
+		SSONamespace:               s.ssoNamespace,
+		Namespaced:                 s.namespaced,
+		SSORBACEnabled:             s.ssoIf != nil && s.ssoIf.IsRBACEnabled(),
+		SSODelegateRBACToNamespace: os.Getenv("SSO_DELEGATE_RBAC_TO_NAMESPACE") == "true",
+		TokenValidators:            len(s.tokenValidators),
+		AuditRedactionRules:        s.auditRedactionRules,
+		NamespaceConflictPolicy:    s.namespaceConflictPolicy,
+		RequireCredentials:         s.requireCredentials,
+		AuditPrimaryGroupRules:     s.auditPrimaryGroupRules,
+		SSOFallbackServiceAccount:  s.ssoFallbackServiceAccount,
+		SSODenyRule:                s.ssoDenyRule,
+		AuthHeaders:                s.authHeaders,
+		ClaimsClockSkew:            s.claimsClockSkew,
+		StreamReauthorization:      s.streamReauthorizationInterval,
+		AnonymousServiceAccount:    s.anonymousServiceAccount,
+		CookieName:                 s.cookieName,
+		SSOAuthorizeTimeout:        s.ssoAuthorizeTimeout,
+		SSORequiredAudience:        s.ssoRequiredAudience,
+		RevocationChecker:          s.revocationChecker != nil,
+		VerboseDenials:             s.verboseDenials,
+		IdentityHeaders:            s.identityHeaders,
+		SSODelegationPreferNS:      s.ssoDelegationPreferNamespace,
+		BearerSchemeAliases:        s.bearerSchemeAliases,
+		SSORBACUnavailable:         s.ssoRBACUnavailableOnTransientErrors,
+		SkipInvalidPrecedence:      s.skipInvalidPrecedence,
+		ClaimsEnricher:             s.claimsEnricher != nil,
+	}
+	if _, ok := s.auditSink.(noopAuditSink); !ok {
+		c.AuditSink = true
+	}
+	if s.restConfig != nil {
+		c.ServerTokenFile = s.restConfig.BearerTokenFile
+	}
+	if s.ssoIf != nil {
+		settings := s.ssoIf.Settings()
+		c.SSO = &settings
+	}
+	if s.clientCache != nil {
+		c.ClientCacheTTL = s.clientCache.ttl
+	}
+	for _, prefix := range s.trustedProxies {
+		c.TrustedProxies = append(c.TrustedProxies, prefix.String())
+	}
+	if s.serviceAccountCache != nil {
+		c.ServiceAccountCacheTTL = s.serviceAccountCache.ttl
+	}
+	if s.tokenMinter != nil {
+		c.ServiceAccountTokenExpiry = s.tokenMinter.expiration
+	}
+	for method := range s.deniedMethods {
+		c.DeniedMethods = append(c.DeniedMethods, method)
+	}
+	sort.Strings(c.DeniedMethods)
+	if s.subjectRateLimiter != nil {
+		c.SubjectRateLimit = float64(s.subjectRateLimiter.limit)
+		c.SubjectRateLimitBurst = s.subjectRateLimiter.burst
+	}
+	c.Modes = s.EnabledModes()
+	for namespace := range s.ssoDelegationNamespaces {
+		c.SSODelegationNamespaces = append(c.SSODelegationNamespaces, namespace)
+	}
+	sort.Strings(c.SSODelegationNamespaces)
+	if s.concurrencyLimiter != nil {
+		c.ConcurrencyLimit = s.concurrencyLimiter.limit
+		for method := range s.concurrencyLimiter.methods {
+			c.ConcurrencyLimitedMethods = append(c.ConcurrencyLimitedMethods, method)
+		}
+		sort.Strings(c.ConcurrencyLimitedMethods)
+	}
+	// map keys are sorted by encoding/json, so this is stable
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 func GetDynamicClient(ctx context.Context) dynamic.Interface {
 	return ctx.Value(DynamicKey).(dynamic.Interface)
 }
@@ -148,40 +484,164 @@ func GetClaims(ctx context.Context) *types.Claims {
 	return config
 }
 
-func getAuthHeaders(md metadata.MD) []string {
+// GetAuthMode returns the mode the request was authenticated with, or "" if it was not authenticated.
+func GetAuthMode(ctx context.Context) Mode {
+	mode, _ := ctx.Value(ModeKey).(Mode)
+	return mode
+}
+
+// WebSocketProtocolPrefix prefixes a base64url encoded token in the `Sec-WebSocket-Protocol` header, which is the only
+// header browsers let WebSocket clients set, e.g. "base64url.bearer.authorization.argoproj.io.QmVhcmVyIHYyOi4uLg".
+const WebSocketProtocolPrefix = "base64url.bearer.authorization.argoproj.io."
+
+// getAuthHeaders returns the candidate tokens in precedence order: `Authorization` headers first, then cookies with the
+// given name (usually `authorization`), then the given custom headers (e.g. `X-Forwarded-Access-Token`), whose values are bearer tokens,
+// then tokens in the `Sec-WebSocket-Protocol` header. The first token valid for an enabled mode is used, so a fresh
+// header always wins over a stale cookie.
+// Browsers do not send cookie domains, but do send the cookies with the most specific path first, so the cookie order
+// is preserved.
+func getAuthHeaders(md metadata.MD, cookieName string, headers []string) []string {
 	// looks for the HTTP header `Authorization: Bearer ...`
-	for _, t := range md.Get("authorization") {
-		return []string{t}
-	}
+	authorizations := slices.Clone(md.Get("authorization"))
 	// check the HTTP cookie
 	// In cases such as wildcard domain cookies, there could be multiple authorization headers
-	var authorizations []string
 	for _, t := range md.Get("cookie") {
 		header := http.Header{}
 		header.Add("Cookie", t)
 		request := http.Request{Header: header}
 		cookies := request.Cookies()
 		for _, c := range cookies {
-			if c.Name == "authorization" {
+			if c.Name == cookieName {
 				authorizations = append(authorizations, c.Value)
 			}
 		}
 	}
+	for _, name := range headers {
+		for _, token := range md.Get(name) {
+			if !strings.HasPrefix(token, "Bearer ") {
+				token = "Bearer " + token
+			}
+			authorizations = append(authorizations, token)
+		}
+	}
+	for _, value := range md.Get("sec-websocket-protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			encoded, ok := strings.CutPrefix(strings.TrimSpace(protocol), WebSocketProtocolPrefix)
+			if !ok {
+				continue
+			}
+			token, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+			if err != nil {
+				log.WithError(err).Debug("ignoring WebSocket protocol token that is not base64url encoded")
+				continue
+			}
+			authorization := string(token)
+			if !strings.HasPrefix(authorization, "Bearer ") && !strings.HasPrefix(authorization, "Basic ") {
+				authorization = "Bearer " + authorization
+			}
+			authorizations = append(authorizations, authorization)
+		}
+	}
 	return authorizations
 }
 
-func (s gatekeeper) getClients(ctx context.Context, req interface{}) (*servertypes.Clients, *types.Claims, error) {
+// peerAddr returns the address the request came from. Requests through the gateway come from loopback, so for them it
+// is the address the gateway appended to `X-Forwarded-For`, i.e. that of the HTTP client.
+func peerAddr(ctx context.Context, md metadata.MD) (netip.Addr, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return netip.Addr{}, false
+	}
+	addrPort, err := netip.ParseAddrPort(p.Addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := addrPort.Addr().Unmap()
+	if forwarded := md.Get("x-forwarded-for"); addr.IsLoopback() && len(forwarded) > 0 {
+		addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+		addr, err = netip.ParseAddr(strings.TrimSpace(addrs[len(addrs)-1]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = addr.Unmap()
+	}
+	return addr, true
+}
+
+// trustedPeer is true if the request came from a trusted proxy, or if every client is trusted.
+func (s *gatekeeper) trustedPeer(ctx context.Context, md metadata.MD) bool {
+	if s.trustedProxies == nil {
+		return true
+	}
+	addr, ok := peerAddr(ctx, md)
+	if !ok {
+		return false
+	}
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeScheme rewrites an authorization using one of the aliases of the `Bearer` scheme (e.g. `Token x` or
+// `JWT x`), compared case-insensitively, to `Bearer x`, which is what the modes expect. Other authorizations are
+// returned unchanged.
+func normalizeScheme(authorization string, aliases []string) string {
+	scheme, credentials, ok := strings.Cut(authorization, " ")
+	if !ok {
+		return authorization
+	}
+	for _, alias := range aliases {
+		if strings.EqualFold(scheme, alias) {
+			return "Bearer " + credentials
+		}
+	}
+	return authorization
+}
+
+func (s gatekeeper) getClients(ctx context.Context, req interface{}) (_ *servertypes.Clients, claims *types.Claims, mode Mode, err error) {
+	// measured for the audit entries, so we can tell which users and providers are slow to authorize
+	start := time.Now()
+	// the claims of a user that was authenticated but then denied, so the denial is audited with the user
+	var deniedClaims *types.Claims
+	defer func() {
+		s.metrics.observeAuthentication(mode, err)
+		if claims == nil {
+			claims = deniedClaims
+		}
+		s.recordAudit(ctx, req, mode, claims, err)
+	}()
 	md, _ := metadata.FromIncomingContext(ctx)
-	authorizations := getAuthHeaders(md)
+	authHeaders := s.authHeaders
+	if len(authHeaders) > 0 && !s.trustedPeer(ctx, md) {
+		// anyone could set them, so only a trusted proxy may
+		authHeaders = nil
+	}
+	authorizations := getAuthHeaders(md, s.cookieName, authHeaders)
+	for i, authorization := range authorizations {
+		authorizations[i] = normalizeScheme(authorization, s.bearerSchemeAliases)
+	}
+	if s.requireCredentials && !slices.ContainsFunc(authorizations, func(authorization string) bool { return authorization != "" }) {
+		return nil, nil, mode, status.Error(codes.Unauthenticated, "no credentials provided. see https://argo-workflows.readthedocs.io/en/latest/faq/")
+	}
 	// Required for GetMode() with Server auth when no auth header specified
 	if len(authorizations) == 0 {
 		authorizations = append(authorizations, "")
 	}
 	valid := false
-	var mode Mode
 	var authorization string
+	var rejected error
 
 	for _, token := range authorizations {
+		// a rejected token is skipped, as another candidate, e.g. a second cookie, may still be valid
+		if err := s.validateToken(token); err != nil {
+			if rejected == nil {
+				rejected = err
+			}
+			continue
+		}
 		mode, valid = s.Modes.GetMode(token)
 		// Stop checking after the first valid token
 		if valid {
@@ -189,9 +649,37 @@ func (s gatekeeper) getClients(ctx context.Context, req interface{}) (*servertyp
 			break
 		}
 	}
+	if !valid && rejected != nil {
+		return nil, nil, mode, status.Error(codes.Unauthenticated, rejected.Error())
+	}
 	if !valid {
-		return nil, nil, status.Error(codes.Unauthenticated, "token not valid. see https://argo-workflows.readthedocs.io/en/latest/faq/")
+		// only the first, highest precedence, token is explained, as that is the one the user most likely meant to send
+		return nil, nil, mode, status.Errorf(codes.Unauthenticated, "token not valid (%s). see https://argo-workflows.readthedocs.io/en/latest/faq/", s.Modes.rejectionReasons(authorizations[0]))
+	}
+	if s.namespaceConflictPolicy == NamespaceConflictReject && hasNamespaceConflict(req) {
+		return nil, nil, mode, status.Errorf(codes.InvalidArgument, "request namespace %q does not match the namespace %q of the object", getNamespace(req), getBodyNamespace(req))
+	}
+	clients, claims, err := s.clientsForMode(ctx, req, mode, authorization, start)
+	if err != nil {
+		deniedClaims = claims
+		return nil, nil, mode, err
 	}
+	// checked once the user is identified, so the denial is audited with them, and unauthenticated users cannot
+	// probe which methods are denied
+	if method, ok := grpc.Method(ctx); ok && s.deniedMethods[method] {
+		deniedClaims = claims
+		return nil, nil, mode, status.Errorf(codes.PermissionDenied, "%s is denied by the server configuration", method)
+	}
+	if err := s.acquireConcurrencySlot(ctx, mode, claims, authorization); err != nil {
+		deniedClaims = claims
+		return nil, nil, mode, err
+	}
+	return clients, claims, mode, nil
+}
+
+// clientsForMode returns the clients and claims for an authorization accepted by the mode. If the user is identified
+// but then denied, the claims are returned along with the error.
+func (s gatekeeper) clientsForMode(ctx context.Context, req interface{}, mode Mode, authorization string, start time.Time) (*servertypes.Clients, *types.Claims, error) {
 	switch mode {
 	case Client:
 		restConfig, clients, err := s.clientForAuthorization(authorization, s.restConfig)
@@ -203,26 +691,96 @@ func (s gatekeeper) getClients(ctx context.Context, req interface{}) (*servertyp
 	case Server:
 		claims, _ := serviceaccount.ClaimSetFor(s.restConfig)
 		return s.clients, claims, nil
+	case Anonymous:
+		serviceAccount, err := s.cache.ServiceAccountLister.ServiceAccounts(s.ssoNamespace).Get(s.anonymousServiceAccount)
+		if err != nil {
+			log.WithError(err).Error("failed to get the anonymous service account")
+			return nil, nil, status.Error(codes.Internal, "anonymous access is misconfigured")
+		}
+		claims := &types.Claims{Claims: jwt.Claims{Subject: AnonymousSubject}}
+		clients, err := s.getClientsForServiceAccount(ctx, claims, serviceAccount)
+		if err != nil {
+			log.WithError(err).Error("failed to get clients for the anonymous service account")
+			return nil, nil, status.Error(codes.Internal, "anonymous access is misconfigured")
+		}
+		return clients, claims, nil
 	case SSO:
-		claims, err := s.ssoIf.Authorize(authorization)
+		claims, err := s.authorize(ctx, authorization)
+		if status.Code(err) == codes.DeadlineExceeded {
+			return nil, nil, err
+		}
 		if err != nil {
 			return nil, nil, status.Error(codes.Unauthenticated, err.Error())
 		}
+		// checked here too, so a stream is never set up with a token that expired after it was authorized
+		if err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, s.claimsClockSkew); err != nil {
+			return nil, nil, status.Errorf(codes.Unauthenticated, "SSO token not valid: %v", err)
+		}
+		if s.ssoRequiredAudience != "" && !claims.Audience.Contains(s.ssoRequiredAudience) {
+			return nil, nil, status.Errorf(codes.Unauthenticated, "SSO token not valid: audience does not include %q", s.ssoRequiredAudience)
+		}
+		if s.revocationChecker != nil {
+			revoked, err := s.revocationChecker.IsRevoked(claims)
+			if err != nil {
+				log.WithError(err).WithFields(s.addClaimsLogFields(claims, addMethodLogField(ctx, log.Fields{}))).Error("failed to check whether the SSO token is revoked")
+				return nil, nil, status.Error(codes.Unavailable, "unable to check the SSO token at the moment, please retry")
+			}
+			if revoked {
+				return nil, nil, status.Error(codes.Unauthenticated, "SSO token not valid: revoked")
+			}
+		}
+		if s.claimsEnricher != nil {
+			if err := s.claimsEnricher.Enrich(ctx, claims); err != nil {
+				log.WithError(err).WithFields(s.addClaimsLogFields(claims, addMethodLogField(ctx, log.Fields{}))).Error("failed to enrich SSO claims")
+				return nil, nil, status.Error(codes.Unavailable, "unable to get the user's details at the moment, please retry")
+			}
+		}
+		if !s.subjectRateLimiter.allow(claims.Subject) {
+			return nil, claims, status.Error(codes.ResourceExhausted, "too many requests, please retry later")
+		}
 		if s.ssoIf.IsRBACEnabled() {
-			clients, err := s.rbacAuthorization(ctx, claims, req)
+			clients, err := s.rbacAuthorization(ctx, claims, req, start)
 			if err != nil {
-				log.WithError(err).Error("failed to perform RBAC authorization")
-				return nil, nil, status.Error(codes.PermissionDenied, "not allowed")
+				log.WithError(err).WithFields(s.addClaimsLogFields(claims, addMethodLogField(ctx, log.Fields{"duration": time.Since(start)}))).Error("failed to perform RBAC authorization")
+				if s.ssoRBACUnavailableOnTransientErrors && isTransient(err) {
+					return nil, claims, status.Error(codes.Unavailable, "unable to perform RBAC authorization at the moment, please retry")
+				}
+				if s.verboseDenials {
+					return nil, claims, status.Errorf(codes.PermissionDenied, "not allowed: %v", err)
+				}
+				return nil, claims, status.Error(codes.PermissionDenied, "not allowed")
 			}
 			return clients, claims, nil
 		} else {
 			// important! write an audit entry (i.e. log entry) so we know which user performed an operation
-			log.WithFields(addClaimsLogFields(claims, nil)).Info("using the default service account for user")
+			log.WithFields(s.addClaimsLogFields(claims, log.Fields{"duration": time.Since(start)})).Info("using the default service account for user")
 			return s.clients, claims, nil
 		}
 	default:
-		panic("this should never happen")
+		// unreachable unless GetMode returns a mode that is not handled here, which must not crash the server
+		log.WithField("mode", mode).Error("unhandled auth mode")
+		return nil, nil, status.Errorf(codes.Internal, "unhandled auth mode %v", mode)
+	}
+}
+
+// acquireConcurrencySlot takes the call's place in the concurrency limiter, the first time the call is authorized.
+// A stream that is authorized again, e.g. for its next message or when it is re-authorized, keeps its place.
+func (s gatekeeper) acquireConcurrencySlot(ctx context.Context, mode Mode, claims *types.Claims, authorization string) error {
+	slot, ok := ctx.Value(concurrencySlotKey{}).(*concurrencySlot)
+	if !ok {
+		return nil
+	}
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.acquired {
+		return nil
 	}
+	release, ok := s.concurrencyLimiter.acquire(slot.method, concurrencyKey(ctx, mode, claims, authorization), s.metrics)
+	if !ok {
+		return status.Errorf(codes.ResourceExhausted, "too many concurrent %s operations, please retry later", slot.method)
+	}
+	slot.acquired, slot.release = true, release
+	return nil
 }
 
 func getNamespace(req interface{}) string {
@@ -236,11 +794,108 @@ func getNamespace(req interface{}) string {
 	return namespacedRequest.GetNamespace()
 }
 
+// getBodyNamespace returns the namespace of the object in the request body (e.g. the workflow of a
+// WorkflowCreateRequest), or "" if there is none.
+func getBodyNamespace(req interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(req))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanInterface() || f.Kind() != reflect.Ptr || f.IsNil() {
+			continue
+		}
+		if obj, ok := f.Interface().(metav1.Object); ok {
+			return obj.GetNamespace()
+		}
+	}
+	return ""
+}
+
+// hasNamespaceConflict is true if the request and the object in its body name different namespaces. An object
+// without a namespace is defaulted to the request namespace, so is not a conflict.
+func hasNamespaceConflict(req interface{}) bool {
+	namespace, bodyNamespace := getNamespace(req), getBodyNamespace(req)
+	return namespace != "" && bodyNamespace != "" && namespace != bodyNamespace
+}
+
+// precedence returns the precedence of the service account, 0 if it is omitted or invalid.
 func precedence(serviceAccount *corev1.ServiceAccount) int {
-	i, _ := strconv.Atoi(serviceAccount.Annotations[common.AnnotationKeyRBACRulePrecedence])
+	i, _ := parsePrecedence(serviceAccount)
 	return i
 }
 
+// parsePrecedence returns the precedence of the service account, and an error if it is set but not an integer.
+func parsePrecedence(serviceAccount *corev1.ServiceAccount) (int, error) {
+	value, ok := serviceAccount.Annotations[common.AnnotationKeyRBACRulePrecedence]
+	if !ok {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation %q: must be an integer", common.AnnotationKeyRBACRulePrecedence, value)
+	}
+	return i, nil
+}
+
+// checkPrecedence returns whether the service account may be selected, warning once about an invalid precedence.
+func (s *gatekeeper) checkPrecedence(serviceAccount *corev1.ServiceAccount) bool {
+	_, err := parsePrecedence(serviceAccount)
+	if err == nil {
+		return true
+	}
+	key := serviceAccount.Namespace + "/" + serviceAccount.Name + "/" + serviceAccount.ResourceVersion
+	if _, warned := s.precedenceWarnings.LoadOrStore(key, true); !warned {
+		log.WithError(err).WithFields(log.Fields{"namespace": serviceAccount.Namespace, "serviceAccount": serviceAccount.Name, "skipped": s.skipInvalidPrecedence}).
+			Warn("SSO RBAC service account has an invalid precedence")
+	}
+	return !s.skipInvalidPrecedence
+}
+
+// rbacRules returns the RBAC rules of the service account, which match if any of them does: the rule annotation, then
+// the numbered rule annotations (e.g. `rbac-rule.1`) in numeric order.
+func rbacRules(serviceAccount *corev1.ServiceAccount) []string {
+	var rules []string
+	if rule, ok := serviceAccount.Annotations[common.AnnotationKeyRBACRule]; ok {
+		rules = append(rules, rule)
+	}
+	var numbers []int
+	for key := range serviceAccount.Annotations {
+		if suffix, ok := strings.CutPrefix(key, common.AnnotationKeyRBACRule+"."); ok {
+			if i, err := strconv.Atoi(suffix); err == nil {
+				numbers = append(numbers, i)
+			}
+		}
+	}
+	sort.Ints(numbers)
+	for _, i := range numbers {
+		rules = append(rules, serviceAccount.Annotations[common.AnnotationKeyRBACRule+"."+strconv.Itoa(i)])
+	}
+	return rules
+}
+
+var (
+	errNoServiceAccountRuleMatches = errors.New("no service account rule matches")
+	errDenyRuleMatches             = errors.New("SSO RBAC deny rule matches")
+)
+
+// denied is true if the deny rule matches the claims.
+func (s *gatekeeper) denied(claims *types.Claims) (bool, error) {
+	if s.ssoDenyRule == "" {
+		return false, nil
+	}
+	v, err := jsonutil.Jsonify(claims)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshall claims: %w", err)
+	}
+	deny, err := s.ruleCache.evalBool(s.ssoDenyRule, v)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate deny rule: %w", err)
+	}
+	return deny, nil
+}
+
 func (s *gatekeeper) getServiceAccount(claims *types.Claims, namespace string) (*corev1.ServiceAccount, error) {
 	list, err := s.cache.ServiceAccountLister.ServiceAccounts(namespace).List(labels.Everything())
 	if err != nil {
@@ -248,29 +903,113 @@ func (s *gatekeeper) getServiceAccount(claims *types.Claims, namespace string) (
 	}
 	var serviceAccounts []*corev1.ServiceAccount
 	for _, serviceAccount := range list {
-		_, ok := serviceAccount.Annotations[common.AnnotationKeyRBACRule]
-		if !ok {
+		if len(rbacRules(serviceAccount)) == 0 || !s.checkPrecedence(serviceAccount) {
 			continue
 		}
 		serviceAccounts = append(serviceAccounts, serviceAccount)
 	}
-	sort.Slice(serviceAccounts, func(i, j int) bool { return precedence(serviceAccounts[i]) > precedence(serviceAccounts[j]) })
-	for _, serviceAccount := range serviceAccounts {
-		rule := serviceAccount.Annotations[common.AnnotationKeyRBACRule]
-		v, err := jsonutil.Jsonify(claims)
+	// ties are broken by name, so the same service account is selected every time
+	sort.SliceStable(serviceAccounts, func(i, j int) bool {
+		if pi, pj := precedence(serviceAccounts[i]), precedence(serviceAccounts[j]); pi != pj {
+			return pi > pj
+		}
+		return serviceAccounts[i].Name < serviceAccounts[j].Name
+	})
+	v, err := jsonutil.Jsonify(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshall claims: %w", err)
+	}
+	var cacheKey serviceAccountCacheKey
+	if s.serviceAccountCache != nil {
+		cacheKey, err = newServiceAccountCacheKey(namespace, v, serviceAccounts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshall claims: %w", err)
 		}
-		allow, err := argoexpr.EvalBool(rule, v)
+		name, ok := s.serviceAccountCache.get(cacheKey)
+		s.metrics.observeServiceAccountCache(ok)
+		if ok {
+			for _, serviceAccount := range serviceAccounts {
+				if serviceAccount.Name == name {
+					return serviceAccount, nil
+				}
+			}
+		}
+	}
+	matches := func(serviceAccount *corev1.ServiceAccount) (bool, error) {
+		for _, rule := range rbacRules(serviceAccount) {
+			allow, err := s.ruleCache.evalBool(rule, v)
+			if err != nil {
+				return false, fmt.Errorf("failed to evaluate rule: %w", err)
+			}
+			if allow {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	for i, serviceAccount := range serviceAccounts {
+		allow, err := matches(serviceAccount)
 		if err != nil {
-			return nil, fmt.Errorf("failed to evaluate rule: %w", err)
+			return nil, err
 		}
 		if !allow {
 			continue
 		}
+		for _, other := range serviceAccounts[i+1:] {
+			if precedence(other) != precedence(serviceAccount) {
+				break
+			}
+			if allow, err := matches(other); err == nil && allow {
+				s.metrics.observeSSORBACTie()
+				log.WithFields(log.Fields{"namespace": namespace, "serviceAccount": serviceAccount.Name, "otherServiceAccount": other.Name, "precedence": precedence(serviceAccount)}).
+					Warn("several SSO RBAC service accounts match with the same precedence, selected the first by name")
+				break
+			}
+		}
+		if s.serviceAccountCache != nil {
+			s.serviceAccountCache.add(cacheKey, serviceAccount.Name)
+		}
 		return serviceAccount, nil
 	}
-	return nil, fmt.Errorf("no service account rule matches")
+	return nil, errNoServiceAccountRuleMatches
+}
+
+// ValidateSSONamespace checks that the SSO namespace exists and contains at least one service account annotated with
+// an RBAC rule. Without one, every SSO login is denied at request time with a rather unhelpful error.
+func ValidateSSONamespace(ctx context.Context, kubeClient kubernetes.Interface, ssoNamespace string) error {
+	_, err := kubeClient.CoreV1().Namespaces().Get(ctx, ssoNamespace, metav1.GetOptions{})
+	switch {
+	case apierr.IsNotFound(err):
+		return fmt.Errorf("SSO namespace %q does not exist, every SSO login will be denied; check the --sso-namespace flag", ssoNamespace)
+	case apierr.IsForbidden(err):
+		// namespaced installs usually cannot get namespaces, fall through to the service account check
+	case err != nil:
+		return fmt.Errorf("failed to get SSO namespace %q: %w", ssoNamespace, err)
+	}
+	list, err := kubeClient.CoreV1().ServiceAccounts(ssoNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list service accounts in SSO namespace %q: %w", ssoNamespace, err)
+	}
+	for _, serviceAccount := range list.Items {
+		if len(rbacRules(&serviceAccount)) > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("SSO namespace %q has no service accounts annotated with %q, every SSO login will be denied; see https://argo-workflows.readthedocs.io/en/latest/argo-server-sso/#sso-rbac", ssoNamespace, common.AnnotationKeyRBACRule)
+}
+
+// ParseSSODelegationNamespaces parses a comma separated list of namespaces that SSO RBAC may be delegated to, e.g.
+// "team-a,team-b". An empty entry is an error, as it is most likely a typo.
+func ParseSSODelegationNamespaces(value string) ([]string, error) {
+	var namespaces []string
+	for _, namespace := range strings.Split(value, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" {
+			return nil, fmt.Errorf("invalid SSO delegation namespaces %q, expected a comma separated list of namespaces", value)
+		}
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces, nil
 }
 
 func (s *gatekeeper) canDelegateRBACToRequestNamespace(req interface{}) bool {
@@ -278,26 +1017,119 @@ func (s *gatekeeper) canDelegateRBACToRequestNamespace(req interface{}) bool {
 		return false
 	}
 	namespace := getNamespace(req)
-	return len(namespace) != 0 && s.ssoNamespace != namespace
+	if namespace == "" {
+		// checked first, so no allowlist entry can delegate requests that are not scoped to a namespace
+		return false
+	}
+	if s.ssoDelegationNamespaces != nil && !s.ssoDelegationNamespaces[namespace] {
+		return false
+	}
+	if s.namespaceConflictPolicy == NamespaceConflictRestrict && hasNamespaceConflict(req) {
+		// a delegated account is only valid for one of the namespaces, so the login account is the most restrictive
+		return false
+	}
+	return s.ssoNamespace != namespace
 }
 
 func (s *gatekeeper) getClientsForServiceAccount(ctx context.Context, claims *types.Claims, serviceAccount *corev1.ServiceAccount) (*servertypes.Clients, error) {
-	authorization, err := s.authorizationForServiceAccount(ctx, serviceAccount)
+	authorization, resourceVersion, err := s.authorizationForServiceAccount(ctx, serviceAccount)
 	if err != nil {
 		return nil, err
 	}
-	_, clients, err := s.clientForAuthorization(authorization, s.restConfig)
-	if err != nil {
-		return nil, err
+	key := clientCacheKey{serviceAccount.Namespace, serviceAccount.Name, resourceVersion}
+	clients, ok := s.clientCache.get(key)
+	if s.clientCache != nil {
+		s.metrics.observeClientCache(ok)
+	}
+	if !ok {
+		_, clients, err = s.clientForAuthorization(authorization, s.restConfig)
+		if err != nil {
+			return nil, err
+		}
+		s.clientCache.add(key, clients)
 	}
 	claims.ServiceAccountName = serviceAccount.Name
 	claims.ServiceAccountNamespace = serviceAccount.Namespace
 	return clients, nil
 }
 
-func (s *gatekeeper) rbacAuthorization(ctx context.Context, claims *types.Claims, req interface{}) (*servertypes.Clients, error) {
+func (s *gatekeeper) EnabledModes() []string {
+	var modes []string
+	for mode, enabled := range s.Modes {
+		if enabled {
+			modes = append(modes, string(mode))
+		}
+	}
+	sort.Strings(modes)
+	return modes
+}
+
+func (s *gatekeeper) Invalidate(namespace, serviceAccountName string) {
+	s.clientCache.invalidate(namespace, serviceAccountName)
+	s.serviceAccountCache.invalidate(namespace, serviceAccountName)
+	s.tokenMinter.invalidate(namespace, serviceAccountName)
+	if s.cache != nil && s.tokenMinter == nil {
+		serviceAccount, err := s.cache.ServiceAccountLister.ServiceAccounts(namespace).Get(serviceAccountName)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"namespace": namespace, "serviceAccount": serviceAccountName}).Warn("failed to get service account to invalidate its token secret")
+		} else {
+			s.cache.InvalidateSecret(namespace, secrets.TokenNameForServiceAccount(serviceAccount))
+		}
+	}
+	log.WithFields(log.Fields{"namespace": namespace, "serviceAccount": serviceAccountName}).Info("invalidated cached clients for service account")
+}
+
+// authorize authorizes the SSO token, giving up with codes.DeadlineExceeded after the timeout, so a slow SSO provider
+// cannot stall requests.
+func (s *gatekeeper) authorize(ctx context.Context, authorization string) (*types.Claims, error) {
+	if s.ssoAuthorizeTimeout <= 0 {
+		return s.ssoIf.Authorize(authorization)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.ssoAuthorizeTimeout)
+	defer cancel()
+	type result struct {
+		claims *types.Claims
+		err    error
+	}
+	// buffered, so the goroutine can finish after we have given up on it
+	results := make(chan result, 1)
+	go func() {
+		claims, err := s.ssoIf.Authorize(authorization)
+		results <- result{claims, err}
+	}()
+	select {
+	case r := <-results:
+		return r.claims, r.err
+	case <-ctx.Done():
+		return nil, status.Errorf(codes.DeadlineExceeded, "SSO authorization did not complete within %v", s.ssoAuthorizeTimeout)
+	}
+}
+
+// isTransient is true for errors getting service accounts and their tokens that may not recur if retried, rather than
+// e.g. a missing or forbidden object, which must be fixed.
+func isTransient(err error) bool {
+	return apierr.IsServerTimeout(err) || apierr.IsTimeout(err) || apierr.IsTooManyRequests(err) ||
+		apierr.IsServiceUnavailable(err) || apierr.IsInternalError(err) || apierr.IsUnexpectedServerError(err) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+func (s *gatekeeper) rbacAuthorization(ctx context.Context, claims *types.Claims, req interface{}, start time.Time) (*servertypes.Clients, error) {
 	ssoDelegationAllowed, ssoDelegated := false, false
+	deny, err := s.denied(claims)
+	if err != nil {
+		return nil, err
+	}
+	if deny {
+		return nil, errDenyRuleMatches
+	}
 	loginAccount, err := s.getServiceAccount(claims, s.ssoNamespace)
+	if errors.Is(err, errNoServiceAccountRuleMatches) && s.ssoFallbackServiceAccount != "" {
+		loginAccount, err = s.cache.ServiceAccountLister.ServiceAccounts(s.ssoNamespace).Get(s.ssoFallbackServiceAccount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SSO RBAC fallback service account: %w", err)
+		}
+		log.WithFields(s.addClaimsLogFields(claims, log.Fields{"serviceAccount": loginAccount.Name})).Info("no SSO RBAC rule matches, using the fallback service account")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -307,36 +1139,72 @@ func (s *gatekeeper) rbacAuthorization(ctx context.Context, claims *types.Claims
 		namespaceAccount, err := s.getServiceAccount(claims, getNamespace(req))
 		if err != nil {
 			log.WithError(err).Info("Error while SSO Delegation")
-		} else if precedence(namespaceAccount) > precedence(loginAccount) {
+		} else if s.ssoDelegationPreferNamespace || precedence(namespaceAccount) > precedence(loginAccount) {
 			delegatedAccount = namespaceAccount
 			ssoDelegated = true
 		}
 	}
+	s.metrics.observeSSODelegation(ssoDelegated)
 	// important! write an audit entry (i.e. log entry) so we know which user performed an operation
-	log.WithFields(log.Fields{"serviceAccount": delegatedAccount.Name, "loginServiceAccount": loginAccount.Name, "subject": claims.Subject, "email": claims.Email, "ssoDelegationAllowed": ssoDelegationAllowed, "ssoDelegated": ssoDelegated}).Info("selected SSO RBAC service account for user")
+	log.WithFields(s.addClaimsLogFields(claims, addMethodLogField(ctx, log.Fields{"serviceAccount": delegatedAccount.Name, "loginServiceAccount": loginAccount.Name, "ssoDelegationAllowed": ssoDelegationAllowed, "ssoDelegated": ssoDelegated, "duration": time.Since(start)}))).Info("selected SSO RBAC service account for user")
 	return s.getClientsForServiceAccount(ctx, claims, delegatedAccount)
 }
 
-func (s *gatekeeper) authorizationForServiceAccount(ctx context.Context, serviceAccount *corev1.ServiceAccount) (string, error) {
+// authorizationForServiceAccount returns the authorization for the service account, and a version of its token: the
+// resource version of the secret it was read from, or the expiry time of a minted token.
+func (s *gatekeeper) authorizationForServiceAccount(ctx context.Context, serviceAccount *corev1.ServiceAccount) (string, string, error) {
+	if s.tokenMinter != nil {
+		t, err := s.tokenMinter.token(ctx, s.clients.Kubernetes, serviceAccount)
+		if err != nil {
+			return "", "", err
+		}
+		return "Bearer " + t.token, t.expiryTime.Format(time.RFC3339Nano), nil
+	}
 	secretName := secrets.TokenNameForServiceAccount(serviceAccount)
 	secret, err := s.cache.GetSecret(ctx, serviceAccount.GetNamespace(), secretName)
 	if err != nil {
-		return "", fmt.Errorf("failed to get service account secret: %w", err)
+		return "", "", fmt.Errorf("failed to get service account secret: %w", err)
 	}
-	return "Bearer " + string(secret.Data["token"]), nil
+	token := secret.Data["token"]
+	if len(token) == 0 {
+		return "", "", fmt.Errorf("service account secret %s/%s of service account %q has no token", secret.Namespace, secretName, serviceAccount.Name)
+	}
+	return "Bearer " + string(token), secret.ResourceVersion, nil
 }
 
-func addClaimsLogFields(claims *types.Claims, fields log.Fields) log.Fields {
+func (s *gatekeeper) addClaimsLogFields(claims *types.Claims, fields log.Fields) log.Fields {
 	if fields == nil {
 		fields = log.Fields{}
 	}
-	fields["subject"] = claims.Subject
+	fields["subject"] = s.redact("sub", claims.Subject)
 	if claims.Email != "" {
-		fields["email"] = claims.Email
+		fields["email"] = s.redact("email", claims.Email)
+	}
+	if group := s.primaryGroup(claims); group != "" {
+		fields["primaryGroup"] = s.redact("groups", group)
+	}
+	if len(claims.Groups) > 0 {
+		groups := claims.Groups
+		if len(groups) > maxLoggedGroups {
+			groups = groups[:maxLoggedGroups]
+		}
+		redacted := make([]string, len(groups))
+		for i, group := range groups {
+			redacted[i] = s.redact("groups", group)
+		}
+		fields["groups"] = redacted
+		fields["groupCount"] = len(claims.Groups)
+	}
+	// an explicit service account field, e.g. the one just selected, is kept
+	if _, ok := fields["serviceAccount"]; !ok && claims.ServiceAccountName != "" {
+		fields["serviceAccount"] = claims.ServiceAccountName
 	}
 	return fields
 }
 
+// maxLoggedGroups bounds the number of groups written to audit log entries, as some users are in hundreds.
+const maxLoggedGroups = 20
+
 func DefaultClientForAuthorization(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
 	restConfig, err := kubeconfig.GetRestConfig(authorization)
 	if err != nil {
@@ -2,20 +2,43 @@ package auth
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	kubefake "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
 
+	workflowpkg "github.com/argoproj/argo-workflows/v3/pkg/apiclient/workflow"
+	wfv1 "github.com/argoproj/argo-workflows/v3/pkg/apis/workflow/v1alpha1"
 	fakewfclientset "github.com/argoproj/argo-workflows/v3/pkg/client/clientset/versioned/fake"
+	"github.com/argoproj/argo-workflows/v3/server/auth/sso"
 	ssomocks "github.com/argoproj/argo-workflows/v3/server/auth/sso/mocks"
 	"github.com/argoproj/argo-workflows/v3/server/auth/types"
 	"github.com/argoproj/argo-workflows/v3/server/cache"
@@ -81,25 +104,25 @@ func TestServer_GetWFClient(t *testing.T) {
 		&corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns"},
 			Data: map[string][]byte{
-				"token": {},
+				"token": []byte("my-token"),
 			},
 		},
 		&corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{Name: "user-secret", Namespace: "user1-ns"},
 			Data: map[string][]byte{
-				"token": {},
+				"token": []byte("my-token"),
 			},
 		},
 		&corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{Name: "user-secret", Namespace: "user2-ns"},
 			Data: map[string][]byte{
-				"token": {},
+				"token": []byte("my-token"),
 			},
 		},
 		&corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{Name: "user-secret", Namespace: "user3-ns"},
 			Data: map[string][]byte{
-				"token": {},
+				"token": []byte("my-token"),
 			},
 		},
 	)
@@ -183,6 +206,7 @@ func TestServer_GetWFClient(t *testing.T) {
 					assert.Equal(t, "my-ns", claims.ServiceAccountNamespace)
 				}
 				assert.Equal(t, "my-sa", hook.LastEntry().Data["serviceAccount"])
+				assertPlausibleDuration(t, hook.LastEntry())
 			}
 		}
 	})
@@ -290,10 +314,1555 @@ func TestServer_GetWFClient(t *testing.T) {
 		if assert.NoError(t, err) {
 			_, err := g.Context(x("Bearer v2:whatever"))
 			assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = not allowed")
+			assertPlausibleDuration(t, hook.LastEntry())
 		}
 	})
 }
 
+func TestGatekeeper_ClientCache(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "true"}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns", ResourceVersion: "1"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var authorizations []string
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		authorizations = append(authorizations, authorization)
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", mock.Anything, mock.Anything).Return(&types.Claims{}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithClientCacheTTL(time.Minute))
+	require.NoError(t, err)
+
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer my-token"}, authorizations, "second request is served from the cache")
+
+	_, err = kubeClient.CoreV1().Secrets("my-ns").Update(context.TODO(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns", ResourceVersion: "2"},
+		Data:       map[string][]byte{"token": []byte("my-rotated-token")},
+	}, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer my-token", "Bearer my-rotated-token"}, authorizations, "rotated token is picked up")
+}
+
+func TestGatekeeper_SSORBACUnavailableOnTransientErrors(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "'my-group' in groups"}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+	)
+	kubeClient.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierr.NewServiceUnavailable("try again")
+	})
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:my-group").Return(&types.Claims{Groups: []string{"my-group"}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:other-group").Return(&types.Claims{Groups: []string{"other-group"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	t.Run("Enabled", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, nil, "my-ns", "my-ns", true, resourceCache, WithSSORBACUnavailableOnTransientErrors())
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer v2:my-group"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		_, err = g.Context(x("Bearer v2:other-group"))
+		assert.Equal(t, codes.PermissionDenied, status.Code(err), "no rule matching is not transient")
+	})
+	t.Run("Disabled", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, nil, "my-ns", "my-ns", true, resourceCache)
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer v2:my-group"))
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+}
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, isTransient(fmt.Errorf("failed to get service account secret: %w", apierr.NewServerTimeout(corev1.Resource("secrets"), "get", 1))))
+	assert.True(t, isTransient(apierr.NewTooManyRequests("slow down", 1)))
+	assert.True(t, isTransient(context.DeadlineExceeded))
+	assert.False(t, isTransient(apierr.NewNotFound(corev1.Resource("secrets"), "my-secret")))
+	assert.False(t, isTransient(apierr.NewForbidden(corev1.Resource("secrets"), "my-secret", errors.New("forbidden"))))
+	assert.False(t, isTransient(errNoServiceAccountRuleMatches))
+}
+
+func TestGatekeeper_Invalidate(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "true"}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns", ResourceVersion: "1"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, time.Minute)
+	resourceCache.Run(context.TODO().Done())
+	var authorizations []string
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		authorizations = append(authorizations, authorization)
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", mock.Anything, mock.Anything).Return(&types.Claims{}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithClientCacheTTL(time.Minute))
+	require.NoError(t, err)
+
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Len(t, g.(*gatekeeper).clientCache.entries, 1)
+
+	_, err = kubeClient.CoreV1().Secrets("my-ns").Update(context.TODO(), &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns", ResourceVersion: "2"},
+		Data:       map[string][]byte{"token": []byte("my-rotated-token")},
+	}, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer my-token"}, authorizations, "stale secret and clients are served from the caches")
+
+	g.Invalidate("my-ns", "my-sa")
+	assert.Empty(t, g.(*gatekeeper).clientCache.entries)
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer my-token", "Bearer my-rotated-token"}, authorizations, "secret is re-read after invalidation")
+}
+
+func TestGatekeeper_ServiceAccountTokenRequest(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "true"}},
+	})
+	var tokenRequests int
+	kubeClient.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		tokenRequests++
+		tokenRequest := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenRequest)
+		assert.Equal(t, int64(3600), *tokenRequest.Spec.ExpirationSeconds)
+		// the API server may shorten the expiration, which is respected
+		tokenRequest.Status = authenticationv1.TokenRequestStatus{
+			Token:               fmt.Sprintf("my-token-%d", tokenRequests),
+			ExpirationTimestamp: metav1.NewTime(time.Now().Add(200 * time.Millisecond)),
+		}
+		return true, tokenRequest, nil
+	})
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var authorizations []string
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		authorizations = append(authorizations, authorization)
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", mock.Anything).Return(&types.Claims{}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{Kubernetes: kubeClient}, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithServiceAccountTokenRequest(time.Hour))
+	require.NoError(t, err)
+
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, tokenRequests, "the token is reused")
+	assert.Equal(t, []string{"Bearer my-token-1", "Bearer my-token-1"}, authorizations)
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, tokenRequests, "the token is minted again once it is close to expiry")
+	assert.Equal(t, "Bearer my-token-2", authorizations[2])
+
+	g.Invalidate("my-ns", "my-sa")
+	_, err = g.Context(x("Bearer v2:whatever"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, tokenRequests, "the token is minted again once invalidated")
+}
+
+func TestGatekeeper_SSOFallbackServiceAccount(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "'my-group' in groups"}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "read-only", Namespace: "my-ns"},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:my-group").Return(&types.Claims{Groups: []string{"my-group"}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:other-group").Return(&types.Claims{Groups: []string{"other-group"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	withFallback, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithSSOFallbackServiceAccount("read-only"))
+	require.NoError(t, err)
+	t.Run("Match", func(t *testing.T) {
+		ctx, err := withFallback.Context(x("Bearer v2:my-group"))
+		require.NoError(t, err)
+		assert.Equal(t, "my-sa", GetClaims(ctx).ServiceAccountName)
+	})
+	t.Run("Fallback", func(t *testing.T) {
+		hook := &test.Hook{}
+		defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+		log.AddHook(hook)
+		ctx, err := withFallback.Context(x("Bearer v2:other-group"))
+		require.NoError(t, err)
+		assert.Equal(t, "read-only", GetClaims(ctx).ServiceAccountName)
+		assert.Equal(t, "no SSO RBAC rule matches, using the fallback service account", hook.AllEntries()[0].Message)
+	})
+	t.Run("NoFallback", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache)
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer v2:other-group"))
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+}
+
+func TestGatekeeper_SSODenyRule(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "'my-group' in groups"}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:corp").Return(&types.Claims{Groups: []string{"my-group"}, Email: "me@corp.com"}, nil)
+	ssoIf.On("Authorize", "Bearer v2:other").Return(&types.Claims{Groups: []string{"my-group"}, Email: "me@other.com"}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache,
+		WithSSODenyRule(`!(email endsWith "@corp.com")`), WithSSOFallbackServiceAccount("my-sa"))
+	require.NoError(t, err)
+	t.Run("NotMatching", func(t *testing.T) {
+		ctx, err := g.Context(x("Bearer v2:corp"))
+		require.NoError(t, err)
+		assert.Equal(t, "my-sa", GetClaims(ctx).ServiceAccountName)
+	})
+	t.Run("Matching", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:other"))
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithSSODenyRule("unknown"))
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer v2:corp"))
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+}
+
+func TestGatekeeper_VerboseDenials(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "'my-group' in groups"}},
+	})
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", mock.Anything).Return(&types.Claims{Claims: jwt.Claims{Subject: "my-sub"}, Groups: []string{"other-group"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	for _, tt := range []struct {
+		name    string
+		opts    []GatekeeperOption
+		message string
+	}{
+		{"Terse", nil, "not allowed"},
+		{"Verbose", []GatekeeperOption{WithVerboseDenials()}, "not allowed: no service account rule matches"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &test.Hook{}
+			defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+			log.AddHook(hook)
+			g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, nil, "my-ns", "my-ns", true, resourceCache, tt.opts...)
+			require.NoError(t, err)
+			_, err = g.Context(x("Bearer v2:whatever"))
+			assert.Equal(t, codes.PermissionDenied, status.Code(err))
+			assert.Equal(t, tt.message, status.Convert(err).Message())
+			entry := hook.LastEntry()
+			require.NotNil(t, entry)
+			assert.Equal(t, "failed to perform RBAC authorization", entry.Message)
+			assert.Equal(t, "my-sub", entry.Data["subject"])
+			assert.ErrorIs(t, entry.Data[log.ErrorKey].(error), errNoServiceAccountRuleMatches)
+		})
+	}
+}
+
+func TestGatekeeper_DeniedMethods(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "'my-group' in groups"}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:whatever").Return(&types.Claims{Claims: jwt.Claims{Subject: "my-sub"}, Groups: []string{"my-group"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	sink := &recordingAuditSink{}
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithAuditSink(sink), WithDeniedMethods("/workflow.WorkflowService/ListWorkflows"))
+	require.NoError(t, err)
+	req := &workflowpkg.WorkflowListRequest{Namespace: "my-ns"}
+	t.Run("Denied", func(t *testing.T) {
+		*sink = nil
+		_, err := g.ContextWithRequest(grpc.NewContextWithServerTransportStream(x("Bearer v2:whatever"), methodStream{method: "/workflow.WorkflowService/ListWorkflows"}), req)
+		require.Equal(t, codes.PermissionDenied, status.Code(err))
+		assert.Equal(t, "/workflow.WorkflowService/ListWorkflows is denied by the server configuration", status.Convert(err).Message())
+		require.Len(t, *sink, 1)
+		assert.False(t, (*sink)[0].Allowed)
+		assert.Equal(t, "my-sub", (*sink)[0].Fields["subject"], "the denial is audited with the user")
+	})
+	t.Run("OtherMethod", func(t *testing.T) {
+		_, err := g.ContextWithRequest(grpc.NewContextWithServerTransportStream(x("Bearer v2:whatever"), methodStream{method: "/workflow.WorkflowService/GetWorkflow"}), req)
+		assert.NoError(t, err)
+	})
+}
+
+// manyServiceAccountsGatekeeper returns a gatekeeper for n SSO RBAC service accounts, of which only the one with the
+// lowest precedence matches "my-group".
+func manyServiceAccountsGatekeeper(t testing.TB, n int) *gatekeeper {
+	var objects []runtime.Object
+	for i := 0; i < n; i++ {
+		rule := fmt.Sprintf("'group-%d' in groups", i)
+		if i == 0 {
+			rule = "'my-group' in groups"
+		}
+		objects = append(objects, &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("sa-%d", i), Namespace: "my-ns",
+			Annotations: map[string]string{common.AnnotationKeyRBACRule: rule, common.AnnotationKeyRBACRulePrecedence: strconv.Itoa(i)},
+		}})
+	}
+	resourceCache := cache.NewResourceCacheWithTimeout(kubefake.NewSimpleClientset(objects...), corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, nil, nil, "my-ns", "my-ns", true, resourceCache)
+	require.NoError(t, err)
+	return g.(*gatekeeper)
+}
+
+func TestGatekeeper_getServiceAccount(t *testing.T) {
+	g := manyServiceAccountsGatekeeper(t, 50)
+	t.Run("LowestPrecedence", func(t *testing.T) {
+		serviceAccount, err := g.getServiceAccount(&types.Claims{Groups: []string{"my-group"}}, "my-ns")
+		require.NoError(t, err)
+		assert.Equal(t, "sa-0", serviceAccount.Name)
+	})
+	t.Run("HighestPrecedence", func(t *testing.T) {
+		serviceAccount, err := g.getServiceAccount(&types.Claims{Groups: []string{"my-group", "group-7", "group-42"}}, "my-ns")
+		require.NoError(t, err)
+		assert.Equal(t, "sa-42", serviceAccount.Name)
+	})
+	t.Run("NoMatch", func(t *testing.T) {
+		_, err := g.getServiceAccount(&types.Claims{Groups: []string{"other-group"}}, "my-ns")
+		assert.ErrorIs(t, err, errNoServiceAccountRuleMatches)
+	})
+}
+
+func TestGatekeeper_getServiceAccount_numberedRules(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{
+			common.AnnotationKeyRBACRule + ".1":    "'group-1' in groups",
+			common.AnnotationKeyRBACRule + ".2":    "'group-2' in groups",
+			common.AnnotationKeyRBACRulePrecedence: "1",
+		}}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default-sa", Namespace: "my-ns", Annotations: map[string]string{
+			common.AnnotationKeyRBACRule: "true",
+		}}},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, nil, nil, "my-ns", "my-ns", true, resourceCache)
+	require.NoError(t, err)
+	serviceAccount, err := g.(*gatekeeper).getServiceAccount(&types.Claims{Groups: []string{"group-2"}}, "my-ns")
+	require.NoError(t, err)
+	assert.Equal(t, "my-sa", serviceAccount.Name)
+	serviceAccount, err = g.(*gatekeeper).getServiceAccount(&types.Claims{Groups: []string{"group-3"}}, "my-ns")
+	require.NoError(t, err)
+	assert.Equal(t, "default-sa", serviceAccount.Name)
+}
+
+func TestGatekeeper_getServiceAccount_cache(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", ResourceVersion: "1", Annotations: map[string]string{
+			common.AnnotationKeyRBACRule: "'my-group' in groups",
+		}}},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, nil, nil, "my-ns", "my-ns", true, resourceCache, WithServiceAccountCacheTTL(time.Minute), WithMetrics(prometheus.NewRegistry()))
+	require.NoError(t, err)
+	hits := func() float64 {
+		return testutil.ToFloat64(g.(*gatekeeper).metrics.serviceAccountCache.WithLabelValues("hit"))
+	}
+	claims := &types.Claims{Groups: []string{"my-group"}}
+	serviceAccount, err := g.(*gatekeeper).getServiceAccount(claims, "my-ns")
+	require.NoError(t, err)
+	assert.Equal(t, "my-sa", serviceAccount.Name)
+	t.Run("SameClaims", func(t *testing.T) {
+		before := hits()
+		serviceAccount, err := g.(*gatekeeper).getServiceAccount(&types.Claims{Groups: []string{"my-group"}}, "my-ns")
+		require.NoError(t, err)
+		assert.Equal(t, "my-sa", serviceAccount.Name)
+		assert.InDelta(t, before+1, hits(), 0)
+	})
+	t.Run("ChangedClaims", func(t *testing.T) {
+		before := hits()
+		_, err := g.(*gatekeeper).getServiceAccount(&types.Claims{Groups: []string{"my-group"}, Email: "me@example.com"}, "my-ns")
+		require.NoError(t, err)
+		_, err = g.(*gatekeeper).getServiceAccount(&types.Claims{Groups: []string{"other-group"}}, "my-ns")
+		assert.ErrorIs(t, err, errNoServiceAccountRuleMatches)
+		assert.InDelta(t, before, hits(), 0)
+	})
+	t.Run("ChangedRule", func(t *testing.T) {
+		_, err := kubeClient.CoreV1().ServiceAccounts("my-ns").Update(context.TODO(), &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", ResourceVersion: "2", Annotations: map[string]string{
+			common.AnnotationKeyRBACRule: "'other-group' in groups",
+		}}}, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			serviceAccount, err := resourceCache.ServiceAccountLister.ServiceAccounts("my-ns").Get("my-sa")
+			return err == nil && serviceAccount.ResourceVersion == "2"
+		}, 5*time.Second, 10*time.Millisecond)
+		_, err = g.(*gatekeeper).getServiceAccount(claims, "my-ns")
+		assert.ErrorIs(t, err, errNoServiceAccountRuleMatches)
+	})
+}
+
+func TestGatekeeper_getServiceAccount_invalidPrecedence(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{
+			common.AnnotationKeyRBACRule:           "true",
+			common.AnnotationKeyRBACRulePrecedence: "high",
+		}}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "other-sa", Namespace: "my-ns", Annotations: map[string]string{
+			common.AnnotationKeyRBACRule:           "true",
+			common.AnnotationKeyRBACRulePrecedence: "0",
+		}}},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	t.Run("Default", func(t *testing.T) {
+		hook := &test.Hook{}
+		defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+		log.AddHook(hook)
+		g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, nil, nil, "my-ns", "my-ns", true, resourceCache)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			serviceAccount, err := g.(*gatekeeper).getServiceAccount(&types.Claims{}, "my-ns")
+			require.NoError(t, err)
+			// precedence 0, so tied with other-sa and selected by name
+			assert.Equal(t, "my-sa", serviceAccount.Name)
+		}
+		var warnings []*log.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "SSO RBAC service account has an invalid precedence" {
+				warnings = append(warnings, entry)
+			}
+		}
+		require.Len(t, warnings, 1)
+		assert.Equal(t, "my-sa", warnings[0].Data["serviceAccount"])
+		assert.EqualError(t, warnings[0].Data[log.ErrorKey].(error), `invalid workflows.argoproj.io/rbac-rule-precedence annotation "high": must be an integer`)
+	})
+	t.Run("Skip", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, nil, nil, "my-ns", "my-ns", true, resourceCache, WithSkipInvalidPrecedence())
+		require.NoError(t, err)
+		serviceAccount, err := g.(*gatekeeper).getServiceAccount(&types.Claims{}, "my-ns")
+		require.NoError(t, err)
+		assert.Equal(t, "other-sa", serviceAccount.Name)
+	})
+}
+
+func TestPrecedence(t *testing.T) {
+	assert.Equal(t, 0, precedence(&corev1.ServiceAccount{}))
+	assert.Equal(t, -1, precedence(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.AnnotationKeyRBACRulePrecedence: "-1"}}}))
+	assert.Equal(t, 0, precedence(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{common.AnnotationKeyRBACRulePrecedence: "high"}}}))
+}
+
+func TestRBACRules(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, rbacRules(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		common.AnnotationKeyRBACRule + ".10":   "c",
+		common.AnnotationKeyRBACRule:           "a",
+		common.AnnotationKeyRBACRule + ".2":    "b",
+		common.AnnotationKeyRBACRule + ".x":    "ignored",
+		common.AnnotationKeyRBACRulePrecedence: "1",
+	}}}))
+}
+
+func TestGatekeeper_getServiceAccount_tie(t *testing.T) {
+	serviceAccount := func(name string) *corev1.ServiceAccount {
+		return &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Namespace: "my-ns",
+			Annotations: map[string]string{common.AnnotationKeyRBACRule: "'my-group' in groups", common.AnnotationKeyRBACRulePrecedence: "1"},
+		}}
+	}
+	resourceCache := cache.NewResourceCacheWithTimeout(kubefake.NewSimpleClientset(serviceAccount("b-sa"), serviceAccount("a-sa"), serviceAccount("c-sa")), corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, nil, nil, "my-ns", "my-ns", true, resourceCache, WithMetrics(prometheus.NewRegistry()))
+	require.NoError(t, err)
+	hook := &test.Hook{}
+	defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+	log.AddHook(hook)
+	for i := 0; i < 3; i++ {
+		selected, err := g.(*gatekeeper).getServiceAccount(&types.Claims{Groups: []string{"my-group"}}, "my-ns")
+		require.NoError(t, err)
+		assert.Equal(t, "a-sa", selected.Name)
+	}
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Equal(t, log.WarnLevel, hook.LastEntry().Level)
+		assert.Equal(t, "b-sa", hook.LastEntry().Data["otherServiceAccount"])
+	}
+	assert.InDelta(t, 3, testutil.ToFloat64(g.(*gatekeeper).metrics.ssoRBACTies), 0)
+}
+
+func BenchmarkGatekeeper_getServiceAccount(b *testing.B) {
+	g := manyServiceAccountsGatekeeper(b, 50)
+	claims := &types.Claims{Claims: jwt.Claims{Subject: "my-sub"}, Email: "me@example.com", Groups: []string{"my-group"}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := g.getServiceAccount(claims, "my-ns"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGatekeeper_Anonymous(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "anonymous", Namespace: "my-ns"},
+			Secrets:    []corev1.ObjectReference{{Name: "anonymous-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "anonymous-secret", Namespace: "my-ns"},
+			Data:       map[string][]byte{"token": []byte("anonymous-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var authorizations []string
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		authorizations = append(authorizations, authorization)
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	t.Run("RequiresServiceAccount", func(t *testing.T) {
+		_, err := NewGatekeeper(Modes{Anonymous: true}, nil, &rest.Config{}, nil, clientForAuthorization, "my-ns", "my-ns", true, resourceCache)
+		assert.Error(t, err)
+	})
+	t.Run("RequiresResourceCache", func(t *testing.T) {
+		_, err := NewGatekeeper(Modes{Anonymous: true}, nil, &rest.Config{}, nil, clientForAuthorization, "my-ns", "my-ns", true, nil, WithAnonymousServiceAccount("anonymous"))
+		assert.EqualError(t, err, "anonymous auth mode requires a resource cache")
+	})
+	g, err := NewGatekeeper(Modes{Anonymous: true, Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithAnonymousServiceAccount("anonymous"))
+	require.NoError(t, err)
+	t.Run("NoToken", func(t *testing.T) {
+		authorizations = nil
+		ctx, err := g.Context(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, Anonymous, GetAuthMode(ctx))
+		assert.Equal(t, []string{"Bearer anonymous-token"}, authorizations)
+		claims := GetClaims(ctx)
+		assert.Equal(t, AnonymousSubject, claims.Subject)
+		assert.Equal(t, "anonymous", claims.ServiceAccountName)
+	})
+	t.Run("Token", func(t *testing.T) {
+		authorizations = nil
+		ctx, err := g.Context(x("Bearer my-token"))
+		require.NoError(t, err)
+		assert.Equal(t, Client, GetAuthMode(ctx))
+		assert.Equal(t, []string{"Bearer my-token"}, authorizations)
+	})
+	t.Run("MissingServiceAccount", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{Anonymous: true}, nil, &rest.Config{}, nil, clientForAuthorization, "my-ns", "my-ns", true, resourceCache, WithAnonymousServiceAccount("missing"))
+		require.NoError(t, err)
+		_, err = g.Context(context.Background())
+		assert.Equal(t, codes.Internal, status.Code(err))
+	})
+}
+
+func TestGatekeeper_authorizationForServiceAccount(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "empty-secret", Namespace: "my-ns"},
+			Data:       map[string][]byte{"token": {}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns", ResourceVersion: "1"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	s := &gatekeeper{cache: resourceCache}
+	serviceAccount := func(secretName string) *corev1.ServiceAccount {
+		return &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns"},
+			Secrets:    []corev1.ObjectReference{{Name: secretName}},
+		}
+	}
+	t.Run("EmptyToken", func(t *testing.T) {
+		_, _, err := s.authorizationForServiceAccount(context.TODO(), serviceAccount("empty-secret"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "empty-secret")
+		assert.Contains(t, err.Error(), "my-sa")
+	})
+	t.Run("Token", func(t *testing.T) {
+		authorization, resourceVersion, err := s.authorizationForServiceAccount(context.TODO(), serviceAccount("my-secret"))
+		require.NoError(t, err)
+		assert.Equal(t, "Bearer my-token", authorization)
+		assert.Equal(t, "1", resourceVersion)
+	})
+}
+
+func TestValidateSSONamespace(t *testing.T) {
+	t.Run("Missing", func(t *testing.T) {
+		err := ValidateSSONamespace(context.TODO(), kubefake.NewSimpleClientset(), "my-ns")
+		assert.ErrorContains(t, err, "does not exist")
+	})
+	t.Run("Empty", func(t *testing.T) {
+		kubeClient := kubefake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "my-ns"}},
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "my-ns"}},
+		)
+		err := ValidateSSONamespace(context.TODO(), kubeClient, "my-ns")
+		assert.ErrorContains(t, err, "has no service accounts annotated")
+	})
+	t.Run("Valid", func(t *testing.T) {
+		kubeClient := kubefake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "my-ns"}},
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+				Name: "my-sa", Namespace: "my-ns",
+				Annotations: map[string]string{common.AnnotationKeyRBACRule: "true"},
+			}},
+		)
+		assert.NoError(t, ValidateSSONamespace(context.TODO(), kubeClient, "my-ns"))
+	})
+}
+
+// newSSODelegationFixture returns the clients, SSO and service accounts for a user in my-group, who matches my-sa in
+// my-ns (precedence 1), user1-sa in user1-ns (precedence 2) and user2-sa in user2-ns (precedence 0).
+func newSSODelegationFixture(t *testing.T) (*servertypes.Clients, ClientForAuthorization, *ssomocks.Interface, *cache.ResourceCache) {
+	t.Helper()
+	// prevent using local KUBECONFIG - which will fail on CI
+	t.Setenv("KUBECONFIG", "/dev/null")
+	var objects []runtime.Object
+	for namespace, name := range map[string]string{"my-ns": "my-sa", "user1-ns": "user1-sa", "user2-ns": "user2-sa"} {
+		precedence := map[string]string{"my-ns": "1", "user1-ns": "2", "user2-ns": "0"}[namespace]
+		objects = append(objects,
+			&corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name, Namespace: namespace,
+					Annotations: map[string]string{
+						common.AnnotationKeyRBACRule:           "'my-group' in groups",
+						common.AnnotationKeyRBACRulePrecedence: precedence,
+					},
+				},
+				Secrets: []corev1.ObjectReference{{Name: "my-secret"}},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: namespace},
+				Data:       map[string][]byte{"token": []byte("my-token")},
+			},
+		)
+	}
+	kubeClient := kubefake.NewSimpleClientset(objects...)
+	resourceCache := cache.NewResourceCache(kubeClient, corev1.NamespaceAll)
+	resourceCache.Run(context.TODO().Done())
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{}, &servertypes.Clients{Workflow: &fakewfclientset.Clientset{}, Kubernetes: &kubefake.Clientset{}}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", mock.Anything, mock.Anything).Return(&types.Claims{Groups: []string{"my-group"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	clients := &servertypes.Clients{Workflow: fakewfclientset.NewSimpleClientset(), Kubernetes: kubeClient}
+	return clients, clientForAuthorization, ssoIf, resourceCache
+}
+
+func TestGatekeeper_SSODelegationNamespaceConflict(t *testing.T) {
+	t.Setenv("SSO_DELEGATE_RBAC_TO_NAMESPACE", "true")
+	clients, clientForAuthorization, ssoIf, resourceCache := newSSODelegationFixture(t)
+	defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+	hook := &test.Hook{}
+	log.AddHook(hook)
+	g, err := NewGatekeeper(Modes{SSO: true}, clients, &rest.Config{Username: "my-username"}, ssoIf, clientForAuthorization, "my-ns", "my-ns", false, resourceCache, WithNamespaceConflictPolicy(NamespaceConflictRestrict))
+	require.NoError(t, err)
+	req := &workflowpkg.WorkflowCreateRequest{Namespace: "user1-ns", Workflow: &wfv1.Workflow{ObjectMeta: metav1.ObjectMeta{Namespace: "user2-ns"}}}
+	ctx, err := g.ContextWithRequest(x("Bearer v2:whatever"), req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "my-sa", GetClaims(ctx).ServiceAccountName)
+		assert.Equal(t, false, hook.LastEntry().Data["ssoDelegationAllowed"])
+	}
+}
+
+func TestParseSSODelegationNamespaces(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		namespaces, err := ParseSSODelegationNamespaces("team-a, team-b")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"team-a", "team-b"}, namespaces)
+	})
+	t.Run("EmptyEntry", func(t *testing.T) {
+		_, err := ParseSSODelegationNamespaces("team-a,,team-b")
+		assert.Error(t, err)
+	})
+	t.Run("TrailingComma", func(t *testing.T) {
+		_, err := ParseSSODelegationNamespaces("team-a,")
+		assert.Error(t, err)
+	})
+}
+
+func TestGatekeeper_Validate(t *testing.T) {
+	rbacSSO := &ssomocks.Interface{}
+	rbacSSO.On("IsRBACEnabled").Return(true)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubefake.NewSimpleClientset(), corev1.NamespaceAll, 0)
+	clients := &servertypes.Clients{Kubernetes: kubefake.NewSimpleClientset()}
+	for _, tt := range []struct {
+		name       string
+		gatekeeper *gatekeeper
+		errors     []string
+	}{
+		{"Valid", &gatekeeper{Modes: Modes{Server: true, SSO: true}, clients: clients, ssoIf: rbacSSO, cache: resourceCache}, nil},
+		{"NoModes", &gatekeeper{Modes: Modes{Server: false}}, []string{"at least one auth mode must be enabled"}},
+		{"ServerWithoutClients", &gatekeeper{Modes: Modes{Server: true}}, []string{"server auth mode requires the server's clients"}},
+		{"SSOWithoutProvider", &gatekeeper{Modes: Modes{SSO: true}}, []string{"sso auth mode requires an SSO provider"}},
+		{"SSORBACWithoutCache", &gatekeeper{Modes: Modes{SSO: true}, ssoIf: rbacSSO}, []string{"SSO RBAC requires a resource cache"}},
+		{"FallbackWithoutCache", &gatekeeper{Modes: Modes{Client: true}, ssoFallbackServiceAccount: "read-only"}, []string{"the SSO RBAC fallback service account requires a resource cache"}},
+		{"TokenRequestWithoutClients", &gatekeeper{Modes: Modes{Client: true}, tokenMinter: newTokenMinter(time.Hour)}, []string{"minting service account tokens requires the server's Kubernetes client"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.gatekeeper.Validate()
+			if tt.errors == nil {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, strings.Join(tt.errors, "\n"), err.Error())
+		})
+	}
+}
+
+func TestGatekeeper_ConfigHash(t *testing.T) {
+	newGatekeeper := func(modes Modes, opts ...GatekeeperOption) Gatekeeper {
+		g, err := NewGatekeeper(modes, nil, nil, nil, nil, "argo", "argo", false, nil, opts...)
+		require.NoError(t, err)
+		return g
+	}
+	hash := newGatekeeper(Modes{Server: true, Client: true}).ConfigHash()
+	assert.Len(t, hash, 64)
+	assert.Equal(t, hash, newGatekeeper(Modes{Client: true, Server: true}).ConfigHash(), "stable")
+	assert.NotEqual(t, hash, newGatekeeper(Modes{Server: true}).ConfigHash(), "modes")
+	assert.NotEqual(t, hash, newGatekeeper(Modes{Server: true, Client: true}, WithNamespaceConflictPolicy(NamespaceConflictReject)).ConfigHash(), "options")
+	assert.NotEqual(t, hash, newGatekeeper(Modes{Server: true, Client: true}, WithAuditSink(&recordingAuditSink{})).ConfigHash(), "audit sink")
+	assert.NotEqual(t, hash, newGatekeeper(Modes{Server: true, Client: true}, WithRevocationChecker(revocationChecker{})).ConfigHash(), "revocation checker")
+	assert.NotEqual(t, hash, newGatekeeper(Modes{Server: true, Client: true}, WithClaimsEnricher(claimsEnricher{})).ConfigHash(), "claims enricher")
+	t.Run("SSO", func(t *testing.T) {
+		newSSOGatekeeper := func(settings sso.Settings) Gatekeeper {
+			ssoIf := &ssomocks.Interface{}
+			ssoIf.On("IsRBACEnabled").Return(false)
+			ssoIf.On("Settings").Return(settings)
+			g, err := NewGatekeeper(Modes{SSO: true}, nil, nil, ssoIf, nil, "argo", "argo", false, nil)
+			require.NoError(t, err)
+			return g
+		}
+		ssoHash := newSSOGatekeeper(sso.Settings{Issuer: "https://my-issuer", ClientID: "my-client"}).ConfigHash()
+		assert.Equal(t, ssoHash, newSSOGatekeeper(sso.Settings{Issuer: "https://my-issuer", ClientID: "my-client"}).ConfigHash(), "stable")
+		assert.NotEqual(t, ssoHash, newSSOGatekeeper(sso.Settings{Issuer: "https://my-other-issuer", ClientID: "my-client"}).ConfigHash(), "issuer")
+		assert.NotEqual(t, ssoHash, newSSOGatekeeper(sso.Settings{Issuer: "https://my-issuer", ClientID: "my-client", FilterGroupsRegex: []string{"^my-"}}).ConfigHash(), "group filter")
+		assert.NotEqual(t, ssoHash, newSSOGatekeeper(sso.Settings{Issuer: "https://my-issuer", ClientID: "my-client", GroupsDelimiters: ","}).ConfigHash(), "groups delimiters")
+	})
+	t.Run("TokenFile", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{Server: true, Client: true}, nil, &rest.Config{BearerTokenFile: "/var/run/argo/token"}, nil, nil, "argo", "argo", false, nil)
+		require.NoError(t, err)
+		assert.NotEqual(t, hash, g.ConfigHash())
+	})
+	t.Run("Metric", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		g := newGatekeeper(Modes{Server: true, Client: true}, WithMetrics(registry))
+		assert.InDelta(t, 1, testutil.ToFloat64(g.(*gatekeeper).metrics.configHash.WithLabelValues(hash)), 0)
+	})
+	t.Setenv("SSO_DELEGATE_RBAC_TO_NAMESPACE", "true")
+	assert.NotEqual(t, hash, newGatekeeper(Modes{Server: true, Client: true}).ConfigHash(), "environment")
+}
+
+func TestGetAuthHeaders(t *testing.T) {
+	t.Run("None", func(t *testing.T) {
+		assert.Empty(t, getAuthHeaders(metadata.MD{}, "authorization", nil))
+	})
+	t.Run("HeaderBeforeCookies", func(t *testing.T) {
+		md := metadata.Pairs("cookie", "authorization=my-cookie; other=x", "authorization", "my-header", "cookie", "authorization=my-other-cookie")
+		assert.Equal(t, []string{"my-header", "my-cookie", "my-other-cookie"}, getAuthHeaders(md, "authorization", nil))
+	})
+	t.Run("CustomHeaderLast", func(t *testing.T) {
+		md := metadata.Pairs("x-forwarded-access-token", "my-token", "authorization", "my-header")
+		assert.Equal(t, []string{"my-header", "Bearer my-token"}, getAuthHeaders(md, "authorization", []string{"X-Forwarded-Access-Token"}))
+	})
+	t.Run("CustomCookieName", func(t *testing.T) {
+		md := metadata.Pairs("cookie", "authorization=default-cookie; argo-a=my-cookie", "cookie", "argo-a=my-other-cookie")
+		assert.Equal(t, []string{"my-cookie", "my-other-cookie"}, getAuthHeaders(md, "argo-a", nil))
+	})
+	t.Run("WebSocketProtocol", func(t *testing.T) {
+		md := metadata.Pairs("sec-websocket-protocol", "v1.argoproj.io, "+WebSocketProtocolPrefix+base64.RawURLEncoding.EncodeToString([]byte("v2:my-token")))
+		assert.Equal(t, []string{"Bearer v2:my-token"}, getAuthHeaders(md, "authorization", nil))
+	})
+	t.Run("WebSocketProtocolLast", func(t *testing.T) {
+		md := metadata.Pairs("sec-websocket-protocol", WebSocketProtocolPrefix+base64.RawURLEncoding.EncodeToString([]byte("Bearer my-protocol-token")), "cookie", "authorization=my-cookie", "authorization", "my-header")
+		assert.Equal(t, []string{"my-header", "my-cookie", "Bearer my-protocol-token"}, getAuthHeaders(md, "authorization", nil))
+	})
+	t.Run("WebSocketProtocolNotEncoded", func(t *testing.T) {
+		md := metadata.Pairs("sec-websocket-protocol", WebSocketProtocolPrefix+"not base64!")
+		assert.Empty(t, getAuthHeaders(md, "authorization", nil))
+	})
+	t.Run("UnconfiguredCustomHeader", func(t *testing.T) {
+		md := metadata.Pairs("x-forwarded-access-token", "my-token")
+		assert.Empty(t, getAuthHeaders(md, "authorization", nil))
+	})
+}
+
+func TestNormalizeScheme(t *testing.T) {
+	aliases := []string{"Token", "JWT"}
+	assert.Equal(t, "Bearer my-token", normalizeScheme("Token my-token", aliases))
+	assert.Equal(t, "Bearer my-token", normalizeScheme("jwt my-token", aliases))
+	assert.Equal(t, "Bearer my-token", normalizeScheme("Bearer my-token", aliases))
+	assert.Equal(t, "Negotiate my-token", normalizeScheme("Negotiate my-token", aliases), "unknown schemes are unchanged")
+	assert.Equal(t, "Token my-token", normalizeScheme("Token my-token", nil))
+	assert.Equal(t, "my-token", normalizeScheme("my-token", aliases))
+}
+
+func TestGatekeeper_BearerSchemeAliases(t *testing.T) {
+	var authorizations []string
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		authorizations = append(authorizations, authorization)
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil, WithBearerSchemeAliases("Token"))
+	require.NoError(t, err)
+	_, err = g.Context(x("Token my-token"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer my-token"}, authorizations)
+}
+
+func TestGatekeeper_RejectionReasons(t *testing.T) {
+	g, err := NewGatekeeper(Modes{Client: true, SSO: true}, nil, &rest.Config{}, &ssomocks.Interface{}, nil, "", "", true, nil)
+	require.NoError(t, err)
+	_, err = g.Context(x("my-secret-token"))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Contains(t, err.Error(), "client: ")
+	assert.Contains(t, err.Error(), "sso: ")
+	assert.NotContains(t, err.Error(), "my-secret-token")
+}
+
+func TestGatekeeper_SSOAuthorizeTimeout(t *testing.T) {
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:slow").After(time.Second).Return(&types.Claims{}, nil)
+	ssoIf.On("Authorize", "Bearer v2:fast").Return(&types.Claims{}, nil)
+	ssoIf.On("IsRBACEnabled").Return(false)
+	g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil, WithSSOAuthorizeTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	t.Run("Slow", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:slow"))
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	})
+	t.Run("Fast", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:fast"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestGatekeeper_ClaimsExpiry(t *testing.T) {
+	now := time.Now()
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:expired").Return(&types.Claims{Claims: jwt.Claims{Expiry: jwt.NewNumericDate(now.Add(-time.Hour))}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:not-yet-valid").Return(&types.Claims{Claims: jwt.Claims{NotBefore: jwt.NewNumericDate(now.Add(time.Hour))}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:skewed").Return(&types.Claims{Claims: jwt.Claims{Expiry: jwt.NewNumericDate(now.Add(-time.Second))}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:valid").Return(&types.Claims{Claims: jwt.Claims{Expiry: jwt.NewNumericDate(now.Add(time.Hour)), NotBefore: jwt.NewNumericDate(now.Add(-time.Hour))}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(false)
+	g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil, WithClaimsClockSkew(time.Minute))
+	require.NoError(t, err)
+	t.Run("Expired", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:expired"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("NotYetValid", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:not-yet-valid"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("WithinSkew", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:skewed"))
+		assert.NoError(t, err)
+	})
+	t.Run("Valid", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:valid"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestGatekeeper_SSORequiredAudience(t *testing.T) {
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:argo").Return(&types.Claims{Claims: jwt.Claims{Audience: jwt.Audience{"other", "argo-server"}}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:other").Return(&types.Claims{Claims: jwt.Claims{Audience: jwt.Audience{"other"}}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(false)
+	t.Run("Configured", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil, WithSSORequiredAudience("argo-server"))
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer v2:argo"))
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer v2:other"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("NotConfigured", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil)
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer v2:other"))
+		assert.NoError(t, err)
+	})
+}
+
+type revocationChecker map[string]error
+
+func (c revocationChecker) IsRevoked(claims *types.Claims) (bool, error) {
+	err, ok := c[claims.ID]
+	return ok && err == nil, err
+}
+
+func TestGatekeeper_RevocationChecker(t *testing.T) {
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:revoked").Return(&types.Claims{Claims: jwt.Claims{ID: "revoked"}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:valid").Return(&types.Claims{Claims: jwt.Claims{ID: "valid"}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:error").Return(&types.Claims{Claims: jwt.Claims{ID: "error"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(false)
+	g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil,
+		WithRevocationChecker(revocationChecker{"revoked": nil, "error": fmt.Errorf("revocation list unavailable")}))
+	require.NoError(t, err)
+	t.Run("Revoked", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:revoked"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("NotRevoked", func(t *testing.T) {
+		ctx, err := g.Context(x("Bearer v2:valid"))
+		require.NoError(t, err)
+		assert.Equal(t, "valid", GetClaims(ctx).ID)
+	})
+	t.Run("Error", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:error"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+type claimsEnricher map[string][]string
+
+func (e claimsEnricher) Enrich(_ context.Context, claims *types.Claims) error {
+	groups, ok := e[claims.Email]
+	if !ok {
+		return fmt.Errorf("unknown user %q", claims.Email)
+	}
+	claims.Groups = append(claims.Groups, groups...)
+	return nil
+}
+
+func TestGatekeeper_ClaimsEnricher(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-sa", Namespace: "my-ns", Annotations: map[string]string{common.AnnotationKeyRBACRule: "'my-team' in groups"}},
+			Secrets:    []corev1.ObjectReference{{Name: "my-secret"}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "my-ns"},
+			Data:       map[string][]byte{"token": []byte("my-token")},
+		},
+	)
+	resourceCache := cache.NewResourceCacheWithTimeout(kubeClient, corev1.NamespaceAll, 0)
+	resourceCache.Run(context.TODO().Done())
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:me").Return(&types.Claims{Email: "me@example.com"}, nil)
+	ssoIf.On("Authorize", "Bearer v2:other").Return(&types.Claims{Email: "other@example.com"}, nil)
+	ssoIf.On("Authorize", "Bearer v2:unknown").Return(&types.Claims{Email: "unknown@example.com"}, nil)
+	ssoIf.On("IsRBACEnabled").Return(true)
+	g, err := NewGatekeeper(Modes{SSO: true}, nil, &rest.Config{}, ssoIf, clientForAuthorization, "my-ns", "my-ns", true, resourceCache,
+		WithClaimsEnricher(claimsEnricher{"me@example.com": {"my-team"}, "other@example.com": {"other-team"}}))
+	require.NoError(t, err)
+	t.Run("EnrichedGroupMatches", func(t *testing.T) {
+		ctx, err := g.Context(x("Bearer v2:me"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"my-team"}, GetClaims(ctx).Groups)
+		assert.Equal(t, "my-sa", GetClaims(ctx).ServiceAccountName)
+	})
+	t.Run("EnrichedGroupDoesNotMatch", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:other"))
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+	t.Run("Error", func(t *testing.T) {
+		_, err := g.Context(x("Bearer v2:unknown"))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestGatekeeper_EnabledModes(t *testing.T) {
+	g, err := NewGatekeeper(Modes{Server: true, SSO: true, Client: false}, &servertypes.Clients{}, &rest.Config{}, nil, nil, "", "", true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"server", "sso"}, g.EnabledModes())
+}
+
+func TestGatekeeper_clientsForMode(t *testing.T) {
+	t.Run("UnhandledMode", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{"bogus": true}, nil, &rest.Config{}, nil, nil, "", "", true, nil)
+		require.NoError(t, err)
+		assert.NotPanics(t, func() {
+			_, _, err = g.(*gatekeeper).clientsForMode(context.Background(), nil, "bogus", "Bearer my-token", time.Now())
+		})
+		assert.Equal(t, codes.Internal, status.Code(err))
+	})
+}
+
+func TestGatekeeper_ClientForAuthorization(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, nil, "", "", true, nil)
+		require.NoError(t, err)
+		assert.NotNil(t, g.(*gatekeeper).clientForAuthorization)
+	})
+	t.Run("Override", func(t *testing.T) {
+		var authorizations []string
+		var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+			authorizations = append(authorizations, authorization)
+			return &rest.Config{}, &servertypes.Clients{}, nil
+		}
+		g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil)
+		require.NoError(t, err)
+		_, err = g.Context(x("Bearer my-token"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bearer my-token"}, authorizations)
+	})
+}
+
+func TestGatekeeper_AuthHeaders(t *testing.T) {
+	var authorizations []string
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		authorizations = append(authorizations, authorization)
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil, WithAuthHeaders("X-Forwarded-Access-Token"))
+	require.NoError(t, err)
+	_, err = g.Context(metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-forwarded-access-token", "my-token")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Bearer my-token"}, authorizations)
+}
+
+func TestGatekeeper_TrustedProxies(t *testing.T) {
+	var authorizations []string
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		authorizations = append(authorizations, authorization)
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil,
+		WithAuthHeaders("X-Forwarded-Access-Token"), WithTrustedProxies(netip.MustParsePrefix("10.0.0.0/8")))
+	require.NoError(t, err)
+	from := func(addr string, kv ...string) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))})
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(append([]string{"x-forwarded-access-token", "my-token"}, kv...)...))
+	}
+	t.Run("Trusted", func(t *testing.T) {
+		authorizations = nil
+		_, err := g.Context(from("10.1.2.3:1234"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bearer my-token"}, authorizations)
+	})
+	t.Run("TrustedThroughGateway", func(t *testing.T) {
+		authorizations = nil
+		_, err := g.Context(from("127.0.0.1:1234", "x-forwarded-for", "192.168.0.1, 10.1.2.3"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bearer my-token"}, authorizations)
+	})
+	t.Run("Untrusted", func(t *testing.T) {
+		authorizations = nil
+		_, err := g.Context(from("192.168.0.1:1234"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.Empty(t, authorizations)
+	})
+	t.Run("UntrustedThroughGateway", func(t *testing.T) {
+		authorizations = nil
+		_, err := g.Context(from("127.0.0.1:1234", "x-forwarded-for", "10.1.2.3, 192.168.0.1"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.Empty(t, authorizations)
+	})
+	t.Run("UntrustedAuthorizationHeader", func(t *testing.T) {
+		authorizations = nil
+		_, err := g.Context(from("192.168.0.1:1234", "authorization", "Bearer my-other-token"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Bearer my-other-token"}, authorizations)
+	})
+}
+
+func TestGatekeeper_HeaderTakesPrecedence(t *testing.T) {
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:header").Return(&types.Claims{Claims: jwt.Claims{Subject: "header-sub"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(false)
+	g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil)
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("cookie", "authorization=invalid", "authorization", "Bearer v2:header"))
+	ctx, err = g.Context(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "header-sub", GetClaims(ctx).Subject)
+}
+
+func TestGatekeeper_SSODelegationNamespaces(t *testing.T) {
+	clients, clientForAuthorization, ssoIf, resourceCache := newSSODelegationFixture(t)
+	defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+	hook := &test.Hook{}
+	log.AddHook(hook)
+	t.Run("DelegationOff", func(t *testing.T) {
+		_, err := NewGatekeeper(Modes{SSO: true}, clients, &rest.Config{Username: "my-username"}, ssoIf, clientForAuthorization, "my-ns", "my-ns", false, resourceCache, WithSSODelegationNamespaces("user1-ns"))
+		assert.Error(t, err)
+	})
+	t.Setenv("SSO_DELEGATE_RBAC_TO_NAMESPACE", "true")
+	t.Run("Allowed", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, clients, &rest.Config{Username: "my-username"}, ssoIf, clientForAuthorization, "my-ns", "my-ns", false, resourceCache, WithSSODelegationNamespaces("user1-ns"))
+		require.NoError(t, err)
+		ctx, err := g.ContextWithRequest(x("Bearer v2:whatever"), servertypes.NamespaceHolder("user1-ns"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "user1-sa", GetClaims(ctx).ServiceAccountName)
+			assert.Equal(t, true, hook.LastEntry().Data["ssoDelegated"])
+		}
+	})
+	t.Run("NotAllowed", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, clients, &rest.Config{Username: "my-username"}, ssoIf, clientForAuthorization, "my-ns", "my-ns", false, resourceCache, WithSSODelegationNamespaces("user2-ns"))
+		require.NoError(t, err)
+		ctx, err := g.ContextWithRequest(x("Bearer v2:whatever"), servertypes.NamespaceHolder("user1-ns"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "my-sa", GetClaims(ctx).ServiceAccountName)
+			assert.Equal(t, false, hook.LastEntry().Data["ssoDelegationAllowed"])
+		}
+	})
+	t.Run("EmptyNamespace", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{SSO: true}, clients, &rest.Config{Username: "my-username"}, ssoIf, clientForAuthorization, "my-ns", "my-ns", false, resourceCache, WithSSODelegationNamespaces("", "user1-ns"))
+		require.NoError(t, err)
+		ctx, err := g.ContextWithRequest(x("Bearer v2:whatever"), servertypes.NamespaceHolder(""))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "my-sa", GetClaims(ctx).ServiceAccountName)
+			assert.Equal(t, false, hook.LastEntry().Data["ssoDelegationAllowed"])
+		}
+	})
+}
+
+func TestGatekeeper_SSODelegationPreferNamespace(t *testing.T) {
+	t.Setenv("SSO_DELEGATE_RBAC_TO_NAMESPACE", "true")
+	clients, clientForAuthorization, ssoIf, resourceCache := newSSODelegationFixture(t)
+	defer log.StandardLogger().ReplaceHooks(log.StandardLogger().ReplaceHooks(log.LevelHooks{}))
+	hook := &test.Hook{}
+	log.AddHook(hook)
+	g, err := NewGatekeeper(Modes{SSO: true}, clients, &rest.Config{Username: "my-username"}, ssoIf, clientForAuthorization, "my-ns", "my-ns", false, resourceCache, WithSSODelegationPreferNamespace())
+	require.NoError(t, err)
+	ctx, err := g.ContextWithRequest(x("Bearer v2:whatever"), servertypes.NamespaceHolder("user2-ns"))
+	if assert.NoError(t, err) {
+		claims := GetClaims(ctx)
+		assert.Equal(t, "user2-sa", claims.ServiceAccountName)
+		assert.Equal(t, "user2-ns", claims.ServiceAccountNamespace)
+		assert.Equal(t, true, hook.LastEntry().Data["ssoDelegated"])
+	}
+}
+
+func TestGatekeeper_ClientClaims(t *testing.T) {
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{BearerToken: strings.TrimPrefix(authorization, "Bearer ")}, &servertypes.Clients{}, nil
+	}
+	g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil)
+	require.NoError(t, err)
+	t.Run("JWT", func(t *testing.T) {
+		// {"sub":"my-sub","email":"me@example.com","groups":["a?>","b?~"]}
+		ctx, err := g.Context(x("Bearer eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiJteS1zdWIiLCJlbWFpbCI6Im1lQGV4YW1wbGUuY29tIiwiZ3JvdXBzIjpbImE_PiIsImI_fiJdfQ.sig"))
+		require.NoError(t, err)
+		assert.Equal(t, "me@example.com", GetClaims(ctx).Email)
+		assert.Equal(t, []string{"a?>", "b?~"}, GetClaims(ctx).Groups)
+	})
+	t.Run("Opaque", func(t *testing.T) {
+		ctx, err := g.Context(x("Bearer opaque"))
+		require.NoError(t, err, "the token is not ours to validate")
+		assert.Nil(t, GetClaims(ctx))
+	})
+}
+
+func TestGatekeeper_TokenValidators(t *testing.T) {
+	called := false
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		called = true
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	denyGarbage := func(authorization string) error {
+		if strings.HasPrefix(authorization, "Bearer garbage") {
+			return errors.New("garbage")
+		}
+		return nil
+	}
+	g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil, WithTokenValidators(denyGarbage))
+	require.NoError(t, err)
+	t.Run("Rejected", func(t *testing.T) {
+		called = false
+		_, err := g.Context(x("Bearer garbage"))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.False(t, called)
+	})
+	t.Run("Accepted", func(t *testing.T) {
+		called = false
+		_, err := g.Context(x("Bearer good"))
+		require.NoError(t, err)
+		assert.True(t, called)
+	})
+	t.Run("RejectedCandidateSkipped", func(t *testing.T) {
+		called = false
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("cookie", "authorization=Bearer garbage; authorization=Bearer good"))
+		_, err := g.Context(ctx)
+		require.NoError(t, err)
+		assert.True(t, called)
+	})
+}
+
+func TestGatekeeper_NamespaceConflict(t *testing.T) {
+	g, err := NewGatekeeper(Modes{Server: true}, &servertypes.Clients{}, &rest.Config{}, nil, nil, "", "", true, nil, WithNamespaceConflictPolicy(NamespaceConflictReject))
+	require.NoError(t, err)
+	t.Run("Conflict", func(t *testing.T) {
+		req := &workflowpkg.WorkflowCreateRequest{Namespace: "my-ns", Workflow: &wfv1.Workflow{ObjectMeta: metav1.ObjectMeta{Namespace: "other-ns"}}}
+		_, err := g.ContextWithRequest(x(""), req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+	t.Run("Same", func(t *testing.T) {
+		req := &workflowpkg.WorkflowCreateRequest{Namespace: "my-ns", Workflow: &wfv1.Workflow{ObjectMeta: metav1.ObjectMeta{Namespace: "my-ns"}}}
+		_, err := g.ContextWithRequest(x(""), req)
+		assert.NoError(t, err)
+	})
+	t.Run("Defaulted", func(t *testing.T) {
+		req := &workflowpkg.WorkflowCreateRequest{Namespace: "my-ns", Workflow: &wfv1.Workflow{}}
+		_, err := g.ContextWithRequest(x(""), req)
+		assert.NoError(t, err)
+	})
+}
+
+func TestGatekeeper_RequireCredentials(t *testing.T) {
+	g, err := NewGatekeeper(Modes{Server: true}, &servertypes.Clients{}, &rest.Config{}, nil, nil, "", "", true, nil, WithRequireCredentials())
+	require.NoError(t, err)
+	t.Run("NoMetadata", func(t *testing.T) {
+		_, err := g.Context(context.Background())
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("EmptyHeader", func(t *testing.T) {
+		_, err := g.Context(x(""))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("Credentials", func(t *testing.T) {
+		_, err := g.Context(x("Bearer my-token"))
+		assert.NoError(t, err)
+	})
+}
+
+func TestGatekeeper_ConcurrencyLimit(t *testing.T) {
+	g, err := NewGatekeeper(Modes{Server: true}, &servertypes.Clients{}, &rest.Config{}, nil, nil, "", "", true, nil, WithConcurrencyLimit(1, "/my.Service/Heavy"))
+	require.NoError(t, err)
+	interceptor := g.UnaryServerInterceptor()
+	heavy := &grpc.UnaryServerInfo{FullMethod: "/my.Service/Heavy"}
+	light := &grpc.UnaryServerInfo{FullMethod: "/my.Service/Light"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	t.Run("OverLimit", func(t *testing.T) {
+		_, err := interceptor(x(""), nil, heavy, func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, err := interceptor(x(""), nil, heavy, ok)
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+			_, err = interceptor(x(""), nil, light, ok)
+			assert.NoError(t, err)
+			return nil, nil
+		})
+		require.NoError(t, err)
+		_, err = interceptor(x(""), nil, heavy, ok)
+		assert.NoError(t, err)
+	})
+	t.Run("ReleasedOnPanic", func(t *testing.T) {
+		assert.Panics(t, func() {
+			_, _ = interceptor(x(""), nil, heavy, func(ctx context.Context, req interface{}) (interface{}, error) { panic("boom") })
+		})
+		_, err = interceptor(x(""), nil, heavy, ok)
+		assert.NoError(t, err)
+	})
+	t.Run("DistinctTokens", func(t *testing.T) {
+		_, err := interceptor(x("my-token"), nil, heavy, func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, err := interceptor(x("my-other-token"), nil, heavy, ok)
+			assert.NoError(t, err)
+			_, err = interceptor(x("my-token"), nil, heavy, ok)
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+			return nil, nil
+		})
+		require.NoError(t, err)
+	})
+	t.Run("Peers", func(t *testing.T) {
+		from := func(ip string) context.Context {
+			return peer.NewContext(x(""), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}})
+		}
+		_, err := interceptor(from("10.0.0.1"), nil, heavy, func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, err := interceptor(from("10.0.0.2"), nil, heavy, ok)
+			assert.NoError(t, err)
+			_, err = interceptor(from("10.0.0.1"), nil, heavy, ok)
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+			return nil, nil
+		})
+		require.NoError(t, err)
+	})
+	t.Run("Stream", func(t *testing.T) {
+		streamInterceptor := g.StreamServerInterceptor()
+		err := streamInterceptor(nil, &fakeServerStream{ctx: x("")}, &grpc.StreamServerInfo{FullMethod: "/my.Service/Heavy"}, func(srv interface{}, ss grpc.ServerStream) error {
+			// the stream keeps its place while it receives messages
+			require.NoError(t, ss.RecvMsg(nil))
+			require.NoError(t, ss.RecvMsg(nil))
+			_, err := interceptor(x(""), nil, heavy, ok)
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+			return nil
+		})
+		require.NoError(t, err)
+		_, err = interceptor(x(""), nil, heavy, ok)
+		assert.NoError(t, err)
+	})
+	t.Run("Audited", func(t *testing.T) {
+		sink := &recordingAuditSink{}
+		g, err := NewGatekeeper(Modes{Server: true}, &servertypes.Clients{}, &rest.Config{}, nil, nil, "", "", true, nil, WithConcurrencyLimit(1, "/my.Service/Heavy"), WithAuditSink(sink))
+		require.NoError(t, err)
+		interceptor := g.UnaryServerInterceptor()
+		_, err = interceptor(x(""), nil, heavy, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptor(x(""), nil, heavy, ok)
+		})
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Len(t, *sink, 2)
+		rejected := (*sink)[1]
+		assert.False(t, rejected.Allowed)
+		assert.Equal(t, codes.ResourceExhausted, status.Code(rejected.Err))
+	})
+}
+
+// fakeServerStream receives an empty message whenever it is read.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeServerStream) RecvMsg(interface{}) error {
+	return nil
+}
+
+// headerStream records the headers set on it, as the gRPC server does.
+type headerStream struct {
+	grpc.ServerTransportStream
+	header metadata.MD
+}
+
+func (s *headerStream) Method() string {
+	return "/my.Service/Method"
+}
+
+func (s *headerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func TestGatekeeper_IdentityHeaders(t *testing.T) {
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:whatever").Return(&types.Claims{Claims: jwt.Claims{Subject: "my-sub"}, Email: "me@example.com"}, nil)
+	ssoIf.On("Authorize", mock.Anything).Return(nil, errors.New("invalid token"))
+	ssoIf.On("IsRBACEnabled").Return(false)
+	g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil, WithIdentityHeaders())
+	require.NoError(t, err)
+	t.Run("Authenticated", func(t *testing.T) {
+		stream := &headerStream{}
+		_, err := g.Context(grpc.NewContextWithServerTransportStream(x("Bearer v2:whatever"), stream))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"my-sub"}, stream.header.Get("x-auth-request-user"))
+		assert.Equal(t, []string{"me@example.com"}, stream.header.Get("x-auth-request-email"))
+	})
+	t.Run("Unauthenticated", func(t *testing.T) {
+		stream := &headerStream{}
+		_, err := g.Context(grpc.NewContextWithServerTransportStream(x("Bearer v2:invalid"), stream))
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.Empty(t, stream.header)
+	})
+	t.Run("Server", func(t *testing.T) {
+		g, err := NewGatekeeper(Modes{Server: true}, &servertypes.Clients{}, &rest.Config{Username: "my-username"}, nil, nil, "", "", true, nil, WithIdentityHeaders())
+		require.NoError(t, err)
+		stream := &headerStream{}
+		ctx, err := g.Context(grpc.NewContextWithServerTransportStream(x(""), stream))
+		require.NoError(t, err)
+		require.Equal(t, "my-username", GetClaims(ctx).Subject)
+		assert.Empty(t, stream.header)
+	})
+}
+
+func TestGatekeeper_SubjectRateLimit(t *testing.T) {
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", "Bearer v2:busy").Return(&types.Claims{Claims: jwt.Claims{Subject: "busy"}}, nil)
+	ssoIf.On("Authorize", "Bearer v2:quiet").Return(&types.Claims{Claims: jwt.Claims{Subject: "quiet"}}, nil)
+	ssoIf.On("IsRBACEnabled").Return(false)
+	g, err := NewGatekeeper(Modes{SSO: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, nil, "", "", true, nil, WithSubjectRateLimit(0.001, 2))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = g.Context(x("Bearer v2:busy"))
+		require.NoError(t, err)
+	}
+	_, err = g.Context(x("Bearer v2:busy"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = g.Context(x("Bearer v2:quiet"))
+	assert.NoError(t, err, "other subjects are not limited")
+
+	limiter := g.(*gatekeeper).subjectRateLimiter
+	limiter.evictFull(time.Now())
+	assert.Contains(t, limiter.limiters, "busy", "subjects that are being limited are kept")
+	assert.Contains(t, limiter.limiters, "quiet")
+	limiter.evictFull(time.Now().Add(time.Hour))
+	assert.NotContains(t, limiter.limiters, "quiet", "subjects with a full bucket are forgotten")
+}
+
+func TestGetAuthMode(t *testing.T) {
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	ssoIf := &ssomocks.Interface{}
+	ssoIf.On("Authorize", mock.Anything).Return(&types.Claims{}, nil)
+	ssoIf.On("IsRBACEnabled").Return(false)
+	for authorization, want := range map[string]Mode{
+		"Bearer my-token":   Client,
+		"":                  Server,
+		"Bearer v2:my-sso":  SSO,
+		"Basic my-password": Client,
+	} {
+		t.Run(string(want)+"/"+authorization, func(t *testing.T) {
+			g, err := NewGatekeeper(Modes{want: true}, &servertypes.Clients{}, &rest.Config{}, ssoIf, clientForAuthorization, "", "", true, nil)
+			require.NoError(t, err)
+			ctx, err := g.Context(x(authorization))
+			require.NoError(t, err)
+			assert.Equal(t, want, GetAuthMode(ctx))
+		})
+	}
+	t.Run("Unauthenticated", func(t *testing.T) {
+		assert.Empty(t, GetAuthMode(context.Background()))
+	})
+}
+
+func TestGatekeeper_Metrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		if authorization != "Bearer good" {
+			return nil, nil, errors.New("invalid token")
+		}
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil, WithMetrics(registry))
+	require.NoError(t, err)
+	m := g.(*gatekeeper).metrics
+
+	_, err = g.Context(x("Bearer good"))
+	require.NoError(t, err)
+	_, err = g.Context(x("Bearer bad"))
+	require.Error(t, err)
+	_, err = g.Context(x("nope"))
+	require.Error(t, err)
+
+	assert.InDelta(t, 1, testutil.ToFloat64(m.authentications.WithLabelValues("client", "success")), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.authentications.WithLabelValues("client", "unauthenticated")), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.authentications.WithLabelValues("none", "unauthenticated")), 0)
+
+	m.observeSSODelegation(true)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.ssoDelegations.WithLabelValues("true")), 0)
+	assert.InDelta(t, 0, testutil.ToFloat64(m.ssoDelegations.WithLabelValues("false")), 0)
+
+	t.Run("Unregistered", func(t *testing.T) {
+		var m *gatekeeperMetrics
+		m.observeAuthentication(Client, nil)
+		m.observeSSODelegation(false)
+	})
+}
+
+func TestGatekeeper_StreamReauthorization(t *testing.T) {
+	var revoked atomic.Bool
+	var clientForAuthorization ClientForAuthorization = func(authorization string, config *rest.Config) (*rest.Config, *servertypes.Clients, error) {
+		if revoked.Load() {
+			return nil, nil, errors.New("token revoked")
+		}
+		return &rest.Config{}, &servertypes.Clients{}, nil
+	}
+	g, err := NewGatekeeper(Modes{Client: true}, nil, &rest.Config{}, nil, clientForAuthorization, "", "", true, nil, WithStreamReauthorization(10*time.Millisecond))
+	require.NoError(t, err)
+	interceptor := g.StreamServerInterceptor()
+	t.Run("Revoked", func(t *testing.T) {
+		revoked.Store(false)
+		err := interceptor(nil, &fakeServerStream{ctx: x("Bearer my-token")}, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+			require.NoError(t, stream.RecvMsg(&workflowpkg.WatchWorkflowsRequest{}))
+			revoked.Store(true)
+			select {
+			case <-stream.Context().Done():
+				return stream.Context().Err()
+			case <-time.After(10 * time.Second):
+				return errors.New("stream was not terminated")
+			}
+		})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		assert.Contains(t, err.Error(), "token revoked")
+	})
+	t.Run("StillValid", func(t *testing.T) {
+		revoked.Store(false)
+		err := interceptor(nil, &fakeServerStream{ctx: x("Bearer my-token")}, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+			require.NoError(t, stream.RecvMsg(&workflowpkg.WatchWorkflowsRequest{}))
+			time.Sleep(50 * time.Millisecond)
+			return stream.Context().Err()
+		})
+		assert.NoError(t, err)
+	})
+	t.Run("NotAuthorizedAtSetup", func(t *testing.T) {
+		revoked.Store(true)
+		err := interceptor(nil, &fakeServerStream{ctx: x("Bearer my-token")}, &grpc.StreamServerInfo{}, func(srv interface{}, stream grpc.ServerStream) error {
+			return stream.RecvMsg(&workflowpkg.WatchWorkflowsRequest{})
+		})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+}
+
+func assertPlausibleDuration(t *testing.T, entry *log.Entry) {
+	t.Helper()
+	duration, ok := entry.Data["duration"].(time.Duration)
+	if assert.True(t, ok, "duration field is missing") {
+		assert.Positive(t, duration)
+		assert.Less(t, duration, time.Minute)
+	}
+}
+
 func x(authorization string) context.Context {
 	return metadata.NewIncomingContext(context.Background(), metadata.New(map[string]string{"authorization": authorization}))
 }
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gatekeeperMetrics counts authentication outcomes per mode, and records the gatekeeper's config and the use of its
+// limiters and caches. A nil *gatekeeperMetrics records nothing.
+type gatekeeperMetrics struct {
+	authentications      *prometheus.CounterVec
+	ssoDelegations       *prometheus.CounterVec
+	ssoRBACTies          prometheus.Counter
+	concurrentOperations *prometheus.GaugeVec
+	configHash           *prometheus.GaugeVec
+	clientCache          *prometheus.CounterVec
+	serviceAccountCache  *prometheus.CounterVec
+}
+
+func newGatekeeperMetrics(registerer prometheus.Registerer) *gatekeeperMetrics {
+	m := &gatekeeperMetrics{
+		authentications: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "argo_server",
+				Name:      "authentications_total",
+				Help:      "Authentications by auth mode and outcome (success, unauthenticated, permission_denied, rate_limited or error).",
+			},
+			[]string{"mode", "outcome"},
+		),
+		ssoDelegations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "argo_server",
+				Name:      "sso_rbac_authorizations_total",
+				Help:      "SSO RBAC authorizations, by whether they were delegated to a namespace service account.",
+			},
+			[]string{"delegated"},
+		),
+		concurrentOperations: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "argo_server",
+				Name:      "concurrent_operations",
+				Help:      "Number of in-flight concurrency limited operations.",
+			},
+			[]string{"method"},
+		),
+		configHash: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "argo_server",
+				Name:      "auth_config_info",
+				Help:      "Hash of the effective auth config. Differing hashes across replicas indicate configuration drift.",
+			},
+			[]string{"hash"},
+		),
+		clientCache: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "argo_server",
+				Name:      "sso_client_cache_total",
+				Help:      "Lookups of the SSO RBAC service account client cache, by result (hit or miss).",
+			},
+			[]string{"result"},
+		),
+		serviceAccountCache: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "argo_server",
+				Name:      "sso_service_account_cache_total",
+				Help:      "Lookups of the SSO RBAC service account selection cache, by result (hit or miss).",
+			},
+			[]string{"result"},
+		),
+	}
+	m.ssoRBACTies = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "argo_server",
+		Name:      "sso_rbac_precedence_ties_total",
+		Help:      "SSO RBAC service account selections where several service accounts matched with the same precedence.",
+	})
+	registerer.MustRegister(m.authentications, m.ssoDelegations, m.ssoRBACTies, m.concurrentOperations, m.configHash, m.clientCache, m.serviceAccountCache)
+	return m
+}
+
+func (m *gatekeeperMetrics) observeAuthentication(mode Mode, err error) {
+	if m == nil {
+		return
+	}
+	outcome := "error"
+	switch status.Code(err) {
+	case codes.OK:
+		outcome = "success"
+	case codes.Unauthenticated:
+		outcome = "unauthenticated"
+	case codes.PermissionDenied:
+		outcome = "permission_denied"
+	case codes.ResourceExhausted:
+		outcome = "rate_limited"
+	}
+	if mode == "" {
+		// no mode accepted the token
+		mode = "none"
+	}
+	m.authentications.WithLabelValues(string(mode), outcome).Inc()
+}
+
+func (m *gatekeeperMetrics) observeSSODelegation(delegated bool) {
+	if m == nil {
+		return
+	}
+	m.ssoDelegations.WithLabelValues(strconv.FormatBool(delegated)).Inc()
+}
+
+func (m *gatekeeperMetrics) observeSSORBACTie() {
+	if m == nil {
+		return
+	}
+	m.ssoRBACTies.Inc()
+}
+
+func (m *gatekeeperMetrics) observeConcurrentOperation(method string, delta float64) {
+	if m == nil {
+		return
+	}
+	m.concurrentOperations.WithLabelValues(method).Add(delta)
+}
+
+// observeConfigHash is set to 1 for the hash of the effective auth config, so replicas can be compared for drift.
+func (m *gatekeeperMetrics) observeConfigHash(hash string) {
+	if m == nil {
+		return
+	}
+	m.configHash.WithLabelValues(hash).Set(1)
+}
+
+func cacheResult(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+func (m *gatekeeperMetrics) observeClientCache(hit bool) {
+	if m == nil {
+		return
+	}
+	m.clientCache.WithLabelValues(cacheResult(hit)).Inc()
+}
+
+func (m *gatekeeperMetrics) observeServiceAccountCache(hit bool) {
+	if m == nil {
+		return
+	}
+	m.serviceAccountCache.WithLabelValues(cacheResult(hit)).Inc()
+}
@@ -15,6 +15,24 @@ type Gatekeeper struct {
 	mock.Mock
 }
 
+// ConfigHash provides a mock function with given fields:
+func (_m *Gatekeeper) ConfigHash() string {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for ConfigHash")
+	}
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
 // Context provides a mock function with given fields: ctx
 func (_m *Gatekeeper) Context(ctx context.Context) (context.Context, error) {
 	ret := _m.Called(ctx)
@@ -75,6 +93,31 @@ func (_m *Gatekeeper) ContextWithRequest(ctx context.Context, req interface{}) (
 	return r0, r1
 }
 
+// EnabledModes provides a mock function with given fields:
+func (_m *Gatekeeper) EnabledModes() []string {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for EnabledModes")
+	}
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func() []string); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	return r0
+}
+
+// Invalidate provides a mock function with given fields: namespace, serviceAccountName
+func (_m *Gatekeeper) Invalidate(namespace string, serviceAccountName string) {
+	_m.Called(namespace, serviceAccountName)
+}
+
 // StreamServerInterceptor provides a mock function with given fields:
 func (_m *Gatekeeper) StreamServerInterceptor() grpc.StreamServerInterceptor {
 	ret := _m.Called()
@@ -115,6 +158,24 @@ func (_m *Gatekeeper) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return r0
 }
 
+// Validate provides a mock function with given fields:
+func (_m *Gatekeeper) Validate() error {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Validate")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // NewGatekeeper creates a new instance of Gatekeeper. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewGatekeeper(t interface {
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/argoproj/argo-workflows/v3/server/auth/sso"
@@ -15,11 +16,13 @@ const (
 	Client Mode = "client"
 	Server Mode = "server"
 	SSO    Mode = "sso"
+	// Anonymous uses a low-privilege service account for requests without a token, e.g. for public dashboards.
+	Anonymous Mode = "anonymous"
 )
 
 func (m Modes) Add(value string) error {
 	switch value {
-	case "client", "server", "sso":
+	case "client", "server", "sso", "anonymous":
 		m[Mode(value)] = true
 	case "hybrid":
 		m[Client] = true
@@ -37,8 +40,37 @@ func (m Modes) GetMode(authorisation string) (Mode, bool) {
 	if m[Client] && (strings.HasPrefix(authorisation, "Bearer ") || strings.HasPrefix(authorisation, "Basic ")) {
 		return Client, true
 	}
+	if m[Anonymous] && authorisation == "" {
+		return Anonymous, true
+	}
 	if m[Server] {
 		return Server, true
 	}
 	return "", false
 }
+
+// rejectionReasons explains why each enabled mode rejected the token, e.g. `client: missing prefix "Bearer " or "Basic "`.
+// The token itself is never included, as it may be a secret. Server mode accepts every token, so it is never listed.
+func (m Modes) rejectionReasons(authorisation string) string {
+	reason := func(prefixes ...string) string {
+		if authorisation == "" {
+			return "no token"
+		}
+		quoted := make([]string, len(prefixes))
+		for i, prefix := range prefixes {
+			quoted[i] = fmt.Sprintf("%q", prefix)
+		}
+		return "missing prefix " + strings.Join(quoted, " or ")
+	}
+	var reasons []string
+	if m[SSO] {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", SSO, reason(sso.Prefix)))
+	}
+	if m[Client] {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", Client, reason("Bearer ", "Basic ")))
+	}
+	if m[Anonymous] {
+		reasons = append(reasons, fmt.Sprintf("%s: only requests without a token are accepted", Anonymous))
+	}
+	return strings.Join(reasons, "; ")
+}
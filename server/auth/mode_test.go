@@ -35,6 +35,12 @@ func TestModes_Add(t *testing.T) {
 			assert.Contains(t, m, SSO)
 		}
 	})
+	t.Run("Anonymous", func(t *testing.T) {
+		m := Modes{}
+		if assert.NoError(t, m.Add("anonymous")) {
+			assert.Contains(t, m, Anonymous)
+		}
+	})
 }
 
 func TestModes_GetMode(t *testing.T) {
@@ -74,3 +80,35 @@ func TestModes_GetMode(t *testing.T) {
 		}
 	})
 }
+
+func TestModes_GetMode_Anonymous(t *testing.T) {
+	m := Modes{Anonymous: true, Client: true, Server: true}
+	t.Run("NoToken", func(t *testing.T) {
+		mode, valid := m.GetMode("")
+		if assert.True(t, valid) {
+			assert.Equal(t, Anonymous, mode)
+		}
+	})
+	t.Run("Token", func(t *testing.T) {
+		mode, valid := m.GetMode("Bearer my-token")
+		if assert.True(t, valid) {
+			assert.Equal(t, Client, mode)
+		}
+	})
+	t.Run("AnonymousOnly", func(t *testing.T) {
+		_, valid := Modes{Anonymous: true}.GetMode("Bearer my-token")
+		assert.False(t, valid)
+	})
+}
+
+func TestModes_rejectionReasons(t *testing.T) {
+	t.Run("ClientAndSSO", func(t *testing.T) {
+		assert.Equal(t, `sso: missing prefix "Bearer v2:"; client: missing prefix "Bearer " or "Basic "`, Modes{Client: true, SSO: true}.rejectionReasons("my-secret"))
+	})
+	t.Run("NoToken", func(t *testing.T) {
+		assert.Equal(t, "client: no token", Modes{Client: true}.rejectionReasons(""))
+	})
+	t.Run("Server", func(t *testing.T) {
+		assert.Empty(t, Modes{Server: true}.rejectionReasons("my-secret"))
+	})
+}
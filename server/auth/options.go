@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GatekeeperOption configures optional behaviour of the gatekeeper.
+type GatekeeperOption func(*gatekeeper)
+
+// NamespaceConflictPolicy is what to do when the namespace of a request differs from the namespace of the object in
+// its body.
+type NamespaceConflictPolicy string
+
+const (
+	// NamespaceConflictIgnore authorizes using the request namespace only.
+	NamespaceConflictIgnore NamespaceConflictPolicy = ""
+	// NamespaceConflictReject rejects the request with codes.InvalidArgument.
+	NamespaceConflictReject NamespaceConflictPolicy = "reject"
+	// NamespaceConflictRestrict authorizes against both namespaces, so SSO RBAC never delegates to either namespace.
+	NamespaceConflictRestrict NamespaceConflictPolicy = "restrict"
+)
+
+// TokenValidator is a cheap check (e.g. format, prefix or deny-list) run against a token before the auth mode is
+// resolved, so that obviously bad tokens are rejected without reaching the more expensive verification.
+// The empty token used for Server auth is validated too. A rejected token is skipped in favour of the next candidate,
+// e.g. another cookie, and the request is only rejected if no candidate is valid.
+type TokenValidator func(authorization string) error
+
+// WithTokenValidators appends validators to the chain run before mode dispatch. The chain is empty by default.
+func WithTokenValidators(validators ...TokenValidator) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.tokenValidators = append(s.tokenValidators, validators...)
+	}
+}
+
+func (s *gatekeeper) validateToken(authorization string) error {
+	for _, validate := range s.tokenValidators {
+		if err := validate(authorization); err != nil {
+			return fmt.Errorf("token rejected: %w", err)
+		}
+	}
+	return nil
+}
+
+// WithConcurrencyLimit limits each subject to at most limit in-flight calls to each of the given gRPC methods, e.g.
+// "/workflow.WorkflowService/SubmitWorkflow". A call to a streaming method is in flight until the stream ends. Calls
+// over the limit fail with codes.ResourceExhausted. Callers without a subject are limited per token, and callers
+// without credentials per address, so callers behind one proxy share a limit.
+func WithConcurrencyLimit(limit int, methods ...string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.concurrencyLimiter = newConcurrencyLimiter(limit, methods)
+	}
+}
+
+// WithMetrics registers the gatekeeper's metrics with the registerer. Without it, no metrics are recorded.
+func WithMetrics(registerer prometheus.Registerer) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.metrics = newGatekeeperMetrics(registerer)
+	}
+}
+
+// WithAuditRedaction sets how claims (by claim name, e.g. "sub" or "email") are redacted in audit entries.
+func WithAuditRedaction(rules map[string]AuditRedaction) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.auditRedactionRules = rules
+	}
+}
+
+// WithNamespaceConflictPolicy sets what to do when the request and the object in its body disagree on the namespace.
+func WithNamespaceConflictPolicy(policy NamespaceConflictPolicy) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.namespaceConflictPolicy = policy
+	}
+}
+
+// WithRequireCredentials rejects requests that carry no credentials at all, rather than treating them as an empty token
+// which Server mode would otherwise accept.
+func WithRequireCredentials() GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.requireCredentials = true
+	}
+}
+
+// WithAuditPrimaryGroup tags audit entries with the user's primary group, selected by the given expressions in
+// precedence order, e.g. `group startsWith "team-"`.
+func WithAuditPrimaryGroup(rules ...string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.auditPrimaryGroupRules = rules
+	}
+}
+
+// WithClientCacheTTL caches the clients built for SSO RBAC service accounts for the given duration. Entries are keyed
+// by the resource version of the token secret, so rotated tokens are picked up as soon as the secret is re-read.
+func WithClientCacheTTL(ttl time.Duration) GatekeeperOption {
+	return func(s *gatekeeper) {
+		if ttl > 0 {
+			s.clientCache = newClientCache(ttl)
+		}
+	}
+}
+
+// WithServiceAccountCacheTTL caches the service account selected by SSO RBAC for the same claims for the given duration,
+// rather than evaluating every rule on every request. Entries are keyed by the resource versions of the service
+// accounts, so edited rules are picked up as soon as the informer sees them.
+func WithServiceAccountCacheTTL(ttl time.Duration) GatekeeperOption {
+	return func(s *gatekeeper) {
+		if ttl > 0 {
+			s.serviceAccountCache = newServiceAccountCache(ttl)
+		}
+	}
+}
+
+// WithAuditSink records every decision with the sink, in addition to the audit log.
+func WithAuditSink(sink AuditSink) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.auditSink = sink
+	}
+}
+
+// WithSSODelegationNamespaces only delegates SSO RBAC to the given namespaces. It requires
+// SSO_DELEGATE_RBAC_TO_NAMESPACE to be enabled. Without it, SSO RBAC may be delegated to any namespace.
+func WithSSODelegationNamespaces(namespaces ...string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.ssoDelegationNamespaces = map[string]bool{}
+		for _, namespace := range namespaces {
+			s.ssoDelegationNamespaces[namespace] = true
+		}
+	}
+}
+
+// WithSSODelegationPreferNamespace delegates SSO RBAC to a matching service account in the request namespace even if
+// its precedence is not higher than the login service account's, e.g. for users that work in many namespaces. The
+// precedence still decides between service accounts in the request namespace.
+func WithSSODelegationPreferNamespace() GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.ssoDelegationPreferNamespace = true
+	}
+}
+
+// WithSSORBACUnavailableOnTransientErrors fails SSO RBAC with codes.Unavailable, which clients may retry, when a
+// service account or its token cannot be read because of a transient error (e.g. an API server timeout), rather than
+// with codes.PermissionDenied. Users that no rule matches are still denied.
+func WithSSORBACUnavailableOnTransientErrors() GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.ssoRBACUnavailableOnTransientErrors = true
+	}
+}
+
+// WithSkipInvalidPrecedence skips SSO RBAC service accounts whose precedence is not an integer, rather than giving them
+// precedence 0. Either way, a warning is logged.
+func WithSkipInvalidPrecedence() GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.skipInvalidPrecedence = true
+	}
+}
+
+// WithSSOFallbackServiceAccount uses the named service account in the SSO namespace for users that no SSO RBAC rule
+// matches, rather than denying them.
+func WithSSOFallbackServiceAccount(name string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.ssoFallbackServiceAccount = name
+	}
+}
+
+// WithSSODenyRule denies SSO users whose claims the rule matches, regardless of the service account rules, e.g.
+// `!(email endsWith "@example.com")`. The rule is an expression, like the `workflows.argoproj.io/rbac-rule` annotation.
+func WithSSODenyRule(rule string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.ssoDenyRule = rule
+	}
+}
+
+// WithAuthHeaders also looks for bearer tokens in the given headers, e.g. "X-Forwarded-Access-Token" from a proxy that
+// strips the `Authorization` header. The `Authorization` header and cookie take precedence.
+func WithAuthHeaders(names ...string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.authHeaders = names
+	}
+}
+
+// WithClaimsClockSkew sets the leeway when checking the expiry and not-before time of SSO claims. It defaults to one
+// minute.
+func WithClaimsClockSkew(skew time.Duration) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.claimsClockSkew = skew
+	}
+}
+
+// WithStreamReauthorization authorizes streams again every interval, and ends them with codes.Unauthenticated once they
+// are no longer authorized. Streams are still authorized when the request is received.
+func WithStreamReauthorization(interval time.Duration) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.streamReauthorizationInterval = interval
+	}
+}
+
+// WithAnonymousServiceAccount sets the service account, in the SSO namespace, used for requests without a token in
+// Anonymous mode. It should only be allowed to read.
+func WithAnonymousServiceAccount(name string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.anonymousServiceAccount = name
+	}
+}
+
+// WithCookieName looks for the token in the named cookie, rather than `authorization`, e.g. so that several Argo Servers
+// on the same parent domain do not use each other's cookies.
+func WithCookieName(name string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.cookieName = name
+	}
+}
+
+// WithSSOAuthorizeTimeout fails SSO authorization with codes.DeadlineExceeded if it takes longer than the timeout.
+func WithSSOAuthorizeTimeout(timeout time.Duration) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.ssoAuthorizeTimeout = timeout
+	}
+}
+
+// WithServiceAccountTokenRequest mints tokens for SSO RBAC and anonymous service accounts with the TokenRequest API,
+// requesting the given expiration, rather than reading them from the service account's token secret. This is needed
+// on clusters that no longer create token secrets for service accounts.
+func WithServiceAccountTokenRequest(expiration time.Duration) GatekeeperOption {
+	return func(s *gatekeeper) {
+		if expiration > 0 {
+			s.tokenMinter = newTokenMinter(expiration)
+		}
+	}
+}
+
+// WithBearerSchemeAliases treats authorizations using any of the schemes (e.g. "Token" or "JWT") as "Bearer", for
+// clients that cannot be changed to send the standard scheme.
+func WithBearerSchemeAliases(schemes ...string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.bearerSchemeAliases = schemes
+	}
+}
+
+// WithTrustedProxies only looks for bearer tokens in the headers given to WithAuthHeaders for requests from the given
+// networks, e.g. that of the proxy that sets them, so that other clients cannot. Other requests are authenticated by
+// the `Authorization` header and cookie only.
+func WithTrustedProxies(prefixes ...netip.Prefix) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.trustedProxies = prefixes
+	}
+}
+
+// WithDeniedMethods denies the full gRPC methods (e.g. "/workflow.WorkflowService/DeleteWorkflow") to every user,
+// whatever their RBAC allows, as a guardrail for dangerous operations.
+func WithDeniedMethods(methods ...string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.deniedMethods = map[string]bool{}
+		for _, method := range methods {
+			s.deniedMethods[method] = true
+		}
+	}
+}
+
+// WithIdentityHeaders echoes the subject and email of users authenticated in Client or SSO mode in the
+// `x-auth-request-user` and `x-auth-request-email` response headers, for proxies and gateways in front of the server.
+func WithIdentityHeaders() GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.identityHeaders = true
+	}
+}
+
+// WithSubjectRateLimit limits each SSO subject to limit authorizations per second, with bursts of up to burst. Requests
+// over the limit fail with codes.ResourceExhausted before SSO RBAC is resolved.
+func WithSubjectRateLimit(limit float64, burst int) GatekeeperOption {
+	return func(s *gatekeeper) {
+		if limit > 0 {
+			s.subjectRateLimiter = newSubjectRateLimiter(limit, burst)
+		}
+	}
+}
+
+// WithVerboseDenials tells clients the reason of a PermissionDenied error, rather than just "not allowed". The subject
+// is only logged. Useful in development, but reveals details of the RBAC configuration, so it should not be used in
+// production.
+func WithVerboseDenials() GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.verboseDenials = true
+	}
+}
+
+// WithClaimsEnricher lets the enricher add to the claims of SSO users, e.g. groups, before they are used for SSO RBAC.
+// If it fails, the request fails with codes.Unavailable.
+func WithClaimsEnricher(enricher ClaimsEnricher) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.claimsEnricher = enricher
+	}
+}
+
+// WithSSORequiredAudience rejects SSO tokens whose audience does not include the audience, regardless of what the SSO
+// provider accepts.
+func WithSSORequiredAudience(audience string) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.ssoRequiredAudience = audience
+	}
+}
+
+// WithRevocationChecker rejects SSO tokens the checker reports as revoked, even though they have not expired.
+func WithRevocationChecker(checker RevocationChecker) GatekeeperOption {
+	return func(s *gatekeeper) {
+		s.revocationChecker = checker
+	}
+}
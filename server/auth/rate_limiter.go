@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxSubjectRateLimiters bounds the number of subjects tracked, beyond which subjects with a full bucket are
+// forgotten, as a new limiter for them would behave the same.
+const maxSubjectRateLimiters = 10000
+
+// subjectRateLimiter limits the rate at which each SSO subject may be authorized, so one user cannot overwhelm the
+// server with SSO RBAC resolutions.
+type subjectRateLimiter struct {
+	limit    rate.Limit
+	burst    int
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newSubjectRateLimiter(limit float64, burst int) *subjectRateLimiter {
+	return &subjectRateLimiter{limit: rate.Limit(limit), burst: burst, limiters: map[string]*rate.Limiter{}}
+}
+
+// allow returns false if the subject has exceeded its rate.
+func (l *subjectRateLimiter) allow(subject string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[subject]
+	if !ok {
+		if len(l.limiters) >= maxSubjectRateLimiters {
+			l.evictFull(time.Now())
+		}
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[subject] = limiter
+	}
+	return limiter.Allow()
+}
+
+func (l *subjectRateLimiter) evictFull(now time.Time) {
+	for subject, limiter := range l.limiters {
+		if limiter.TokensAt(now) >= float64(l.burst) {
+			delete(l.limiters, subject)
+		}
+	}
+}
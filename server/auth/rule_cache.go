@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+
+	"github.com/argoproj/argo-workflows/v3/util/expr/argoexpr"
+)
+
+// maxRuleCacheEntries bounds the cache, as entries for rules that have since been edited are never read again.
+const maxRuleCacheEntries = 1000
+
+// ruleCacheKey includes the names and types of the claims, because a rule is type-checked against the claims it is
+// compiled with, e.g. a rule referring to `groups` does not compile for claims without groups.
+type ruleCacheKey struct {
+	rule  string
+	shape string
+}
+
+// ruleCache caches the compiled programs of SSO RBAC rules, which are otherwise re-parsed for every service account
+// on every request. Keying by the rule means an edited annotation is compiled afresh.
+type ruleCache struct {
+	mu       sync.Mutex
+	programs map[ruleCacheKey]*vm.Program
+}
+
+func newRuleCache() *ruleCache {
+	return &ruleCache{programs: map[ruleCacheKey]*vm.Program{}}
+}
+
+func (c *ruleCache) evalBool(rule string, env map[string]interface{}) (bool, error) {
+	key := ruleCacheKey{rule: rule, shape: envShape(env)}
+	c.mu.Lock()
+	program, ok := c.programs[key]
+	c.mu.Unlock()
+	if !ok {
+		var err error
+		program, err = expr.Compile(rule, expr.Env(env))
+		if err != nil {
+			return false, err
+		}
+		c.mu.Lock()
+		if len(c.programs) >= maxRuleCacheEntries {
+			c.programs = map[ruleCacheKey]*vm.Program{}
+		}
+		c.programs[key] = program
+		c.mu.Unlock()
+	}
+	return argoexpr.RunBool(program, env)
+}
+
+func envShape(env map[string]interface{}) string {
+	names := make([]string, 0, len(env))
+	for name, value := range env {
+		names = append(names, fmt.Sprintf("%s:%T", name, value))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/argoproj/argo-workflows/v3/util/expr/argoexpr"
+)
+
+func TestRuleCache(t *testing.T) {
+	c := newRuleCache()
+	withGroups := map[string]interface{}{"groups": []interface{}{"my-group"}}
+	t.Run("Cached", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			allow, err := c.evalBool(`"my-group" in groups`, withGroups)
+			require.NoError(t, err)
+			assert.True(t, allow)
+		}
+		assert.Len(t, c.programs, 1)
+	})
+	t.Run("EditedRule", func(t *testing.T) {
+		allow, err := c.evalBool(`"other-group" in groups`, withGroups)
+		require.NoError(t, err)
+		assert.False(t, allow)
+	})
+	t.Run("DifferentClaims", func(t *testing.T) {
+		_, err := c.evalBool(`"my-group" in groups`, map[string]interface{}{"sub": "my-sub"})
+		assert.ErrorContains(t, err, "unknown name groups")
+	})
+	t.Run("NotBool", func(t *testing.T) {
+		_, err := c.evalBool(`groups`, withGroups)
+		assert.ErrorContains(t, err, "unable to cast expression result")
+	})
+}
+
+func benchmarkRules() []string {
+	var rules []string
+	for i := 0; i < 20; i++ {
+		rules = append(rules, fmt.Sprintf(`"group-%d" in groups && email endsWith "@example.com"`, i))
+	}
+	return rules
+}
+
+var benchmarkClaims = map[string]interface{}{
+	"sub":    "my-sub",
+	"email":  "me@example.com",
+	"groups": []interface{}{"group-19"},
+}
+
+func BenchmarkRules(b *testing.B) {
+	rules := benchmarkRules()
+	b.Run("Parsed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, rule := range rules {
+				if _, err := argoexpr.EvalBool(rule, benchmarkClaims); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		c := newRuleCache()
+		for i := 0; i < b.N; i++ {
+			for _, rule := range rules {
+				if _, err := c.evalBool(rule, benchmarkClaims); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// serviceAccountCacheKey includes the resource versions of the candidate service accounts, so an edited RBAC rule or
+// precedence, or an added or deleted service account, is never served from the cache.
+type serviceAccountCacheKey struct {
+	namespace string
+	// a hash of every claim, rather than just the groups, subject and email, as a rule may refer to any claim
+	claims          string
+	serviceAccounts string
+}
+
+func newServiceAccountCacheKey(namespace string, claims map[string]interface{}, serviceAccounts []*corev1.ServiceAccount) (serviceAccountCacheKey, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return serviceAccountCacheKey{}, err
+	}
+	claimsHash := sha256.Sum256(data)
+	serviceAccountsHash := sha256.New()
+	for _, serviceAccount := range serviceAccounts {
+		serviceAccountsHash.Write([]byte(serviceAccount.Name + ":" + serviceAccount.ResourceVersion + "\n"))
+	}
+	return serviceAccountCacheKey{
+		namespace:       namespace,
+		claims:          hex.EncodeToString(claimsHash[:]),
+		serviceAccounts: hex.EncodeToString(serviceAccountsHash.Sum(nil)),
+	}, nil
+}
+
+type serviceAccountCacheEntry struct {
+	serviceAccountName string
+	expiryTime         time.Time
+}
+
+// serviceAccountCache caches the SSO RBAC service account selected for claims, which is otherwise re-selected by
+// evaluating every rule on every request.
+type serviceAccountCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[serviceAccountCacheKey]serviceAccountCacheEntry
+}
+
+func newServiceAccountCache(ttl time.Duration) *serviceAccountCache {
+	return &serviceAccountCache{ttl: ttl, entries: map[serviceAccountCacheKey]serviceAccountCacheEntry{}}
+}
+
+func (c *serviceAccountCache) get(key serviceAccountCacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().Before(entry.expiryTime) {
+		return entry.serviceAccountName, true
+	}
+	return "", false
+}
+
+func (c *serviceAccountCache) add(key serviceAccountCacheKey, serviceAccountName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// evict expired entries, including those for previous resource versions, which are never read again
+	for k, entry := range c.entries {
+		if !now.Before(entry.expiryTime) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = serviceAccountCacheEntry{serviceAccountName: serviceAccountName, expiryTime: now.Add(c.ttl)}
+}
+
+// invalidate drops the entries that selected the service account.
+func (c *serviceAccountCache) invalidate(namespace, serviceAccountName string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, entry := range c.entries {
+		if k.namespace == namespace && entry.serviceAccountName == serviceAccountName {
+			delete(c.entries, k)
+		}
+	}
+}
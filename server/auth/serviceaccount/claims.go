@@ -13,6 +13,19 @@ import (
 	"github.com/argoproj/argo-workflows/v3/server/auth/types"
 )
 
+// UseTokenFile returns a copy of the config that authenticates with the token in the file, rather than its own
+// credentials, including any exec or auth provider, which client-go would otherwise prefer to the token. client-go
+// re-reads the file every minute, and ClaimSetFor on every call, so a rotated token is picked up.
+func UseTokenFile(restConfig *rest.Config, path string) *rest.Config {
+	c := rest.CopyConfig(restConfig)
+	c.Username, c.Password = "", ""
+	c.BearerToken = ""
+	c.ExecProvider = nil
+	c.AuthProvider, c.AuthConfigPersister = nil, nil
+	c.BearerTokenFile = path
+	return c
+}
+
 func ClaimSetFor(restConfig *rest.Config) (*types.Claims, error) {
 	username := restConfig.Username
 	if username != "" {
@@ -31,8 +44,13 @@ func ClaimSetFor(restConfig *rest.Config) (*types.Claims, error) {
 		if len(parts) != 3 {
 			return nil, fmt.Errorf("expected bearer token to be a JWT and therefore have 3 dot-delimited parts")
 		}
-		payload := parts[1]
-		data, err := base64.RawStdEncoding.DecodeString(payload)
+		// JWTs are base64url encoded, but standard encoding is still accepted from older tokens, which only ever worked
+		// when the payload happened to be valid in both
+		payload := strings.TrimRight(parts[1], "=")
+		data, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(payload)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode bearer token's JWT payload: %w", err)
 		}
@@ -1,11 +1,16 @@
 package serviceaccount
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 // sub = 1234567890
@@ -37,6 +42,16 @@ func TestClaimSetFor(t *testing.T) {
 		}
 	})
 
+	t.Run("OIDCBearerToken", func(t *testing.T) {
+		// base64url payload, containing "_", of {"sub":"my-sub","email":"me@example.com","groups":["a?>","b?~"]}
+		claims, err := ClaimSetFor(&rest.Config{BearerToken: "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiJteS1zdWIiLCJlbWFpbCI6Im1lQGV4YW1wbGUuY29tIiwiZ3JvdXBzIjpbImE_PiIsImI_fiJdfQ.sig"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "my-sub", claims.Subject)
+			assert.Equal(t, "me@example.com", claims.Email)
+			assert.Equal(t, []string{"a?>", "b?~"}, claims.Groups)
+		}
+	})
+
 	// set-up test
 	tmp, err := os.CreateTemp("", "")
 	assert.NoError(t, err)
@@ -52,3 +67,50 @@ func TestClaimSetFor(t *testing.T) {
 		}
 	})
 }
+
+func TestUseTokenFile(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte(token), 0o600))
+
+	config := UseTokenFile(&rest.Config{Host: server.URL, Username: "my-username", Password: "my-password"}, path)
+	claims, err := ClaimSetFor(config)
+	require.NoError(t, err)
+	assert.Equal(t, "1234567890", claims.Subject)
+	httpClient, err := rest.HTTPClientFor(config)
+	require.NoError(t, err)
+	resp, err := httpClient.Get(server.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "Bearer "+token, authorization)
+
+	t.Run("Rotated", func(t *testing.T) {
+		// sub = my-rotated-sub
+		rotated := "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiJteS1yb3RhdGVkLXN1YiJ9.sig"
+		require.NoError(t, os.WriteFile(path, []byte(rotated), 0o600))
+		claims, err := ClaimSetFor(config)
+		require.NoError(t, err)
+		assert.Equal(t, "my-rotated-sub", claims.Subject)
+	})
+	t.Run("Providers", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte(token), 0o600))
+		config := UseTokenFile(&rest.Config{
+			Host:         server.URL,
+			ExecProvider: &clientcmdapi.ExecConfig{Command: "my-credential-plugin", APIVersion: "client.authentication.k8s.io/v1"},
+			AuthProvider: &clientcmdapi.AuthProviderConfig{Name: "oidc"},
+		}, path)
+		assert.Nil(t, config.ExecProvider)
+		assert.Nil(t, config.AuthProvider)
+		authorization = ""
+		httpClient, err := rest.HTTPClientFor(config)
+		require.NoError(t, err)
+		resp, err := httpClient.Get(server.URL)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, "Bearer "+token, authorization)
+	})
+}
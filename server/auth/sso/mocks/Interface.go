@@ -7,6 +7,8 @@ import (
 
 	mock "github.com/stretchr/testify/mock"
 
+	sso "github.com/argoproj/argo-workflows/v3/server/auth/sso"
+
 	types "github.com/argoproj/argo-workflows/v3/server/auth/types"
 )
 
@@ -73,6 +75,24 @@ func (_m *Interface) IsRBACEnabled() bool {
 	return r0
 }
 
+// Settings provides a mock function with given fields:
+func (_m *Interface) Settings() sso.Settings {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Settings")
+	}
+
+	var r0 sso.Settings
+	if rf, ok := ret.Get(0).(func() sso.Settings); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(sso.Settings)
+	}
+
+	return r0
+}
+
 // NewInterface creates a new instance of Interface. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewInterface(t interface {
@@ -15,6 +15,10 @@ func (n nullService) IsRBACEnabled() bool {
 	return false
 }
 
+func (n nullService) Settings() Settings {
+	return Settings{}
+}
+
 func (n nullService) Authorize(string) (*types.Claims, error) {
 	return nil, fmt.Errorf("not implemented")
 }
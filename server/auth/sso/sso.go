@@ -43,6 +43,19 @@ type Interface interface {
 	HandleRedirect(writer http.ResponseWriter, request *http.Request)
 	HandleCallback(writer http.ResponseWriter, request *http.Request)
 	IsRBACEnabled() bool
+	Settings() Settings
+}
+
+// Settings are the SSO settings that affect who is authorized and how, excluding secrets.
+type Settings struct {
+	Issuer               string        `json:"issuer,omitempty"`
+	ClientID             string        `json:"clientId,omitempty"`
+	Scopes               []string      `json:"scopes,omitempty"`
+	CustomGroupClaimName string        `json:"customGroupClaimName,omitempty"`
+	FilterGroupsRegex    []string      `json:"filterGroupsRegex,omitempty"`
+	UserInfoPath         string        `json:"userInfoPath,omitempty"`
+	SessionExpiry        time.Duration `json:"sessionExpiry,omitempty"`
+	GroupsDelimiters     string        `json:"groupsDelimiters,omitempty"`
 }
 
 var _ Interface = &sso{}
@@ -63,12 +76,29 @@ type sso struct {
 	customClaimName   string
 	userInfoPath      string
 	filterGroupsRegex []*regexp.Regexp
+	groupsDelimiters  string
 }
 
 func (s *sso) IsRBACEnabled() bool {
 	return s.rbacConfig.IsEnabled()
 }
 
+func (s *sso) Settings() Settings {
+	settings := Settings{
+		Issuer:               s.issuer,
+		ClientID:             s.config.ClientID,
+		Scopes:               s.config.Scopes,
+		CustomGroupClaimName: s.customClaimName,
+		UserInfoPath:         s.userInfoPath,
+		SessionExpiry:        s.expiry,
+		GroupsDelimiters:     s.groupsDelimiters,
+	}
+	for _, regex := range s.filterGroupsRegex {
+		settings.FilterGroupsRegex = append(settings.FilterGroupsRegex, regex.String())
+	}
+	return settings
+}
+
 // Abstract methods of oidc.Provider that our code uses into an interface. That
 // will allow us to implement a stub for unit testing.  If you start using more
 // oidc.Provider methods in this file, add them here and provide a stub
@@ -215,6 +245,7 @@ func newSso(
 		userInfoPath:      c.UserInfoPath,
 		issuer:            c.Issuer,
 		filterGroupsRegex: filterGroupsRegex,
+		groupsDelimiters:  c.GroupsDelimiters,
 	}, nil
 }
 
@@ -271,7 +302,12 @@ func (s *sso) HandleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	c := &types.Claims{}
-	if err := idToken.Claims(c); err != nil {
+	var claims interface{} = c
+	if s.groupsDelimiters != "" {
+		// the groups may then be a single delimited string
+		claims = (*types.StringGroupsClaims)(c)
+	}
+	if err := idToken.Claims(claims); err != nil {
 		log.WithError(err).Error("failed to get claims from the id token")
 		w.WriteHeader(401)
 		return
@@ -280,9 +316,13 @@ func (s *sso) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	// extract groups based on that claim key
 	groups := c.Groups
 	if s.customClaimName != "" {
-		groups, err = c.GetCustomGroup(s.customClaimName)
-		if err != nil {
-			log.Warn(err)
+		if group, ok := c.RawClaim[s.customClaimName].(string); ok && s.groupsDelimiters != "" {
+			groups = []string{group}
+		} else {
+			groups, err = c.GetCustomGroup(s.customClaimName)
+			if err != nil {
+				log.Warn(err)
+			}
 		}
 	}
 	// Some SSO implementations (Okta) require a call to
@@ -296,6 +336,8 @@ func (s *sso) HandleCallback(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	groups = types.SplitGroups(groups, s.groupsDelimiters)
+
 	// only return groups that match at least one of the regexes
 	if s.filterGroupsRegex != nil && len(s.filterGroupsRegex) > 0 {
 		var filteredGroups []string
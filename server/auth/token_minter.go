@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type mintedToken struct {
+	token string
+	// the token is minted again after this time, well before it expires
+	refreshTime time.Time
+	expiryTime  time.Time
+}
+
+// tokenMinter mints short-lived tokens for service accounts with the TokenRequest API, for clusters where service
+// accounts no longer have a long-lived token secret. Tokens are reused for half of their lifetime.
+type tokenMinter struct {
+	expiration time.Duration
+	mu         sync.Mutex
+	tokens     map[string]mintedToken
+}
+
+func newTokenMinter(expiration time.Duration) *tokenMinter {
+	return &tokenMinter{expiration: expiration, tokens: map[string]mintedToken{}}
+}
+
+func (m *tokenMinter) token(ctx context.Context, kubeClient kubernetes.Interface, serviceAccount *corev1.ServiceAccount) (mintedToken, error) {
+	key := serviceAccount.Namespace + "/" + serviceAccount.Name
+	m.mu.Lock()
+	t, ok := m.tokens[key]
+	m.mu.Unlock()
+	if ok && time.Now().Before(t.refreshTime) {
+		return t, nil
+	}
+	expirationSeconds := int64(m.expiration.Seconds())
+	tokenRequest, err := kubeClient.CoreV1().ServiceAccounts(serviceAccount.Namespace).CreateToken(ctx, serviceAccount.Name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &expirationSeconds},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return mintedToken{}, fmt.Errorf("failed to create token for service account %s/%s: %w", serviceAccount.Namespace, serviceAccount.Name, err)
+	}
+	now := time.Now()
+	expiryTime := tokenRequest.Status.ExpirationTimestamp.Time
+	// the API server may shorten (or lengthen) the expiration we asked for
+	t = mintedToken{token: tokenRequest.Status.Token, refreshTime: now.Add(expiryTime.Sub(now) / 2), expiryTime: expiryTime}
+	m.mu.Lock()
+	m.tokens[key] = t
+	m.mu.Unlock()
+	return t, nil
+}
+
+func (m *tokenMinter) invalidate(namespace, serviceAccountName string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, namespace+"/"+serviceAccountName)
+}
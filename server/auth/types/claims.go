@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/go-jose/go-jose/v3/jwt"
 )
@@ -40,14 +42,29 @@ func (c *Claims) UnmarshalJSON(data []byte) error {
 	type claimAlias Claims
 	var localClaim claimAlias = claimAlias(*c)
 
-	// Populate the claims struct as much as possible
-	err := json.Unmarshal(data, &localClaim)
+	// Populate the raw data struct
+	err := json.Unmarshal(data, &localClaim.RawClaim)
 	if err != nil {
 		return err
 	}
 
-	// Populate the raw data struct
-	err = json.Unmarshal(data, &localClaim.RawClaim)
+	// Some non-conforming providers send the subject as an array, which would fail to unmarshal into a string
+	if sub, ok := localClaim.RawClaim["sub"]; ok && sub != nil {
+		if _, isString := sub.(string); !isString {
+			subject, err := coerceSubject(sub)
+			if err != nil {
+				return err
+			}
+			localClaim.RawClaim["sub"] = subject
+			data, err = json.Marshal(localClaim.RawClaim)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Populate the claims struct as much as possible
+	err = json.Unmarshal(data, &localClaim)
 	if err != nil {
 		return err
 	}
@@ -60,10 +77,56 @@ func (c *Claims) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// StringGroupsClaims unmarshals like Claims, but also accepts a groups claim sent as a single string, e.g. a delimited
+// string to split with SplitGroups, rather than failing to unmarshal it into a slice.
+type StringGroupsClaims Claims
+
+func (c *StringGroupsClaims) UnmarshalJSON(data []byte) error {
+	var rawClaim map[string]interface{}
+	if err := json.Unmarshal(data, &rawClaim); err != nil {
+		return err
+	}
+	if groups, ok := rawClaim["groups"].(string); ok {
+		rawClaim["groups"] = []interface{}{groups}
+		var err error
+		data, err = json.Marshal(rawClaim)
+		if err != nil {
+			return err
+		}
+	}
+	return (*Claims)(c).UnmarshalJSON(data)
+}
+
+// coerceSubject returns the subject from a "sub" claim that is either a string or an array containing exactly one
+// string. An array of several subjects is ambiguous, so is an error.
+func coerceSubject(sub interface{}) (string, error) {
+	switch v := sub.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		if len(v) != 1 {
+			return "", fmt.Errorf("ambiguous subject claim: expected exactly one subject, got %d", len(v))
+		}
+		subject, ok := v[0].(string)
+		if !ok {
+			return "", fmt.Errorf("subject claim %v was not a string", v[0])
+		}
+		return subject, nil
+	default:
+		return "", fmt.Errorf("subject claim %v was not a string", sub)
+	}
+}
+
 // GetCustomGroup is responsible for extracting groups based on the
 // provided custom claim key
+// GetCustomGroup returns the groups in the named claim. The name may also be a dot separated path to a nested claim,
+// e.g. "resource_access.*.roles", where "*" matches every key and concatenates the groups found under each. A claim
+// whose name contains dots (e.g. "https://example.com/groups") takes precedence over a nested one.
 func (c *Claims) GetCustomGroup(customKeyName string) ([]string, error) {
 	groups, ok := c.RawClaim[customKeyName]
+	if !ok {
+		groups, ok = getClaimPath(c.RawClaim, strings.Split(customKeyName, "."))
+	}
 	if !ok {
 		return nil, fmt.Errorf("no claim found for key: %v", customKeyName)
 	}
@@ -85,6 +148,62 @@ func (c *Claims) GetCustomGroup(customKeyName string) ([]string, error) {
 	return newSlice, nil
 }
 
+// SplitGroups splits each group on any of the delimiters, for providers that send the groups as a single delimited
+// string. Empty groups are dropped. If delimiters is empty, the groups are returned unchanged.
+func SplitGroups(groups []string, delimiters string) []string {
+	if delimiters == "" {
+		return groups
+	}
+	var split []string
+	for _, group := range groups {
+		for _, g := range strings.FieldsFunc(group, func(r rune) bool { return strings.ContainsRune(delimiters, r) }) {
+			if g = strings.TrimSpace(g); g != "" {
+				split = append(split, g)
+			}
+		}
+	}
+	return split
+}
+
+func getClaimPath(claim interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return claim, true
+	}
+	m, ok := claim.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if path[0] != "*" {
+		value, ok := m[path[0]]
+		if !ok {
+			return nil, false
+		}
+		return getClaimPath(value, path[1:])
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	// sorted, so the groups are in a stable order
+	sort.Strings(keys)
+	var groups []interface{}
+	found := false
+	for _, key := range keys {
+		value, ok := getClaimPath(m[key], path[1:])
+		if !ok {
+			continue
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			// not an array, so return it as is for the caller to reject
+			return value, true
+		}
+		groups = append(groups, items...)
+		found = true
+	}
+	return groups, found
+}
+
 func (c *Claims) GetUserInfoGroups(httpClient HttpClient, accessToken, issuer, userInfoPath string) ([]string, error) {
 	url := fmt.Sprintf("%s%s", issuer, userInfoPath)
 	request, err := http.NewRequest("GET", url, nil)
@@ -3,6 +3,7 @@ package types
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"testing"
@@ -156,6 +157,36 @@ func TestUnmarshalJSON(t *testing.T) {
 				EmailVerified: true,
 			},
 		},
+		{
+			description: "subject as string",
+			data:        `{"sub":"my-sub"}`,
+			expectedErr: nil,
+			expectedClaims: &Claims{
+				Claims:   jwt.Claims{Subject: "my-sub"},
+				RawClaim: map[string]interface{}{"sub": "my-sub"},
+			},
+		},
+		{
+			description: "subject as single element array",
+			data:        `{"sub":["my-sub"]}`,
+			expectedErr: nil,
+			expectedClaims: &Claims{
+				Claims:   jwt.Claims{Subject: "my-sub"},
+				RawClaim: map[string]interface{}{"sub": "my-sub"},
+			},
+		},
+		{
+			description:    "subject as multi element array",
+			data:           `{"sub":["my-sub","other-sub"]}`,
+			expectedErr:    errors.New("ambiguous subject claim: expected exactly one subject, got 2"),
+			expectedClaims: &Claims{},
+		},
+		{
+			description:    "subject as number",
+			data:           `{"sub":1}`,
+			expectedErr:    errors.New("subject claim 1 was not a string"),
+			expectedClaims: &Claims{},
+		},
 		{
 			description: "unmarshal no data",
 			data:        `{}`,
@@ -175,6 +206,28 @@ func TestUnmarshalJSON(t *testing.T) {
 	}
 }
 
+func TestStringGroupsClaims(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		err := json.Unmarshal([]byte(`{"groups":"my-group,other-group"}`), &Claims{})
+		assert.Error(t, err, "a string is only accepted when opted in")
+	})
+	t.Run("String", func(t *testing.T) {
+		claims := &StringGroupsClaims{}
+		err := json.Unmarshal([]byte(`{"sub":"my-sub","groups":"my-group,other-group"}`), claims)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "my-sub", claims.Subject)
+			assert.Equal(t, []string{"my-group,other-group"}, claims.Groups)
+		}
+	})
+	t.Run("Array", func(t *testing.T) {
+		claims := &StringGroupsClaims{}
+		err := json.Unmarshal([]byte(`{"groups":["my-group"]}`), claims)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"my-group"}, claims.Groups)
+		}
+	})
+}
+
 func TestGetCustomGroup(t *testing.T) {
 
 	t.Run("NoCustomGroupSet", func(t *testing.T) {
@@ -220,6 +273,66 @@ func TestGetCustomGroup(t *testing.T) {
 		_, err := claims.GetCustomGroup(("ad_groups"))
 		assert.Error(t, err)
 	})
+	t.Run("NestedCustomGroup", func(t *testing.T) {
+		claims := &Claims{RawClaim: map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": []interface{}{"my-group"}},
+		}}
+		groups, err := claims.GetCustomGroup("realm_access.roles")
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"my-group"}, groups)
+		}
+	})
+	t.Run("NestedCustomGroupWildcard", func(t *testing.T) {
+		claims := &Claims{RawClaim: map[string]interface{}{
+			"resource_access": map[string]interface{}{
+				"workflows": map[string]interface{}{"roles": []interface{}{"workflows-admin"}},
+				"account":   map[string]interface{}{"roles": []interface{}{"manage-account"}},
+				"other":     map[string]interface{}{},
+			},
+		}}
+		groups, err := claims.GetCustomGroup("resource_access.*.roles")
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"manage-account", "workflows-admin"}, groups)
+		}
+	})
+	t.Run("NestedCustomGroupMissing", func(t *testing.T) {
+		claims := &Claims{RawClaim: map[string]interface{}{
+			"realm_access": map[string]interface{}{},
+		}}
+		_, err := claims.GetCustomGroup("realm_access.roles")
+		assert.EqualError(t, err, "no claim found for key: realm_access.roles")
+	})
+	t.Run("DottedCustomGroupName", func(t *testing.T) {
+		claims := &Claims{RawClaim: map[string]interface{}{
+			"https://example.com/groups": []interface{}{"my-group"},
+		}}
+		groups, err := claims.GetCustomGroup("https://example.com/groups")
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"my-group"}, groups)
+		}
+	})
+}
+
+func TestSplitGroups(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		assert.Equal(t, []string{"my-group,other-group"}, SplitGroups([]string{"my-group,other-group"}, ""))
+	})
+	t.Run("Comma", func(t *testing.T) {
+		claims := &StringGroupsClaims{}
+		err := json.Unmarshal([]byte(`{"groups":"my-group, other-group,,third-group"}`), claims)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"my-group", "other-group", "third-group"}, SplitGroups(claims.Groups, ","))
+		}
+	})
+	t.Run("CommaOrSpace", func(t *testing.T) {
+		assert.Equal(t, []string{"my-group", "other-group", "third-group"}, SplitGroups([]string{"my-group other-group,third-group"}, ", "))
+	})
+	t.Run("Array", func(t *testing.T) {
+		assert.Equal(t, []string{"my-group", "other-group"}, SplitGroups([]string{"my-group", "other-group"}, ","))
+	})
+	t.Run("SingleGroup", func(t *testing.T) {
+		assert.Equal(t, []string{"my group"}, SplitGroups([]string{"my group"}, ","))
+	})
 }
 
 type HttpClientMock struct {
@@ -3,4 +3,5 @@ package cache
 type Interface interface {
 	Get(key string) (any, bool)
 	Add(key string, value any)
+	Remove(key string)
 }
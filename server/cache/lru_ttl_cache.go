@@ -36,6 +36,10 @@ func (c *lruTtlCache) Get(key string) (any, bool) {
 	return nil, false
 }
 
+func (c *lruTtlCache) Remove(key string) {
+	c.cache.Remove(key)
+}
+
 func (c *lruTtlCache) Add(key string, value any) {
 	c.cache.Add(key, &item{
 		expiryTime: currentTime().Add(c.timeout),
@@ -56,6 +56,11 @@ func (c *ResourceCache) GetSecret(ctx context.Context, namespace string, secretN
 	return secret, nil
 }
 
+// InvalidateSecret drops the secret from the cache, so it is re-read from the server when next requested.
+func (c *ResourceCache) InvalidateSecret(namespace string, secretName string) {
+	c.cache.Remove(c.getSecretCacheKey(namespace, secretName))
+}
+
 func (c *ResourceCache) getSecretFromServer(ctx context.Context, namespace string, secretName string) (*corev1.Secret, error) {
 	return c.client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
 }
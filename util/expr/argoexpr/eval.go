@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
 )
 
 func EvalBool(input string, env interface{}) (bool, error) {
@@ -11,9 +12,14 @@ func EvalBool(input string, env interface{}) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	return RunBool(program, env)
+}
+
+// RunBool runs an already compiled program, such as one cached by the caller, and casts the result to bool.
+func RunBool(program *vm.Program, env interface{}) (bool, error) {
 	result, err := expr.Run(program, env)
 	if err != nil {
-		return false, fmt.Errorf("unable to evaluate expression '%s': %s", input, err)
+		return false, fmt.Errorf("unable to evaluate expression '%s': %s", program.Source().String(), err)
 	}
 	resultBool, ok := result.(bool)
 	if !ok {